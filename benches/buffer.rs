@@ -0,0 +1,61 @@
+//! Measure the time needed to hash files from a high-latency filesystem
+//! depending on the size of the read buffer.
+//! Run with `cargo bench --bench buffer`.
+
+use std::fs;
+use std::io;
+use std::io::Read;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use tempdir::TempDir;
+
+use osync::index::{ComputeOptions, Index};
+
+const FILES: usize = 10;
+const FILE_SIZE: usize = 1024 * 1024;
+
+// the latency simulated for each read
+const LATENCY: Duration = Duration::from_micros(200);
+
+/// A reader simulating a network filesystem where each read has a fixed latency.
+struct SlowReader {
+    inner: Box<dyn Read>,
+}
+
+impl Read for SlowReader {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        thread::sleep(LATENCY);
+        self.inner.read(buf)
+    }
+}
+
+fn main() {
+    let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+    for i in 0..FILES {
+        fs::write(
+            dir.path().join(format!("{}.slow", i)),
+            vec![i as u8; FILE_SIZE],
+        )
+        .expect("unable to write test file");
+    }
+
+    for buffer_size in &[8 * 1024, 32 * 1024, 128 * 1024, 1024 * 1024] {
+        let options = ComputeOptions::new()
+            .buffer_size(*buffer_size)
+            .decompressor("slow", |inner| Box::new(SlowReader { inner }));
+
+        let start = Instant::now();
+        Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        let elapsed = start.elapsed();
+
+        println!(
+            "compute: {} files of {} KiB with a {} KiB buffer in {:?}",
+            FILES,
+            FILE_SIZE / 1024,
+            buffer_size / 1024,
+            elapsed
+        );
+    }
+}
@@ -0,0 +1,65 @@
+//! Measure the time & the peak memory used to save a large index.
+//! Run with `cargo bench --bench save`.
+
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::Instant;
+
+use tempdir::TempDir;
+
+use osync::index::Index;
+
+const ENTRIES: usize = 1_000_000;
+
+/// An allocator keeping track of the peak memory usage.
+struct CountingAllocator;
+
+static CURRENT: AtomicUsize = AtomicUsize::new(0);
+static PEAK: AtomicUsize = AtomicUsize::new(0);
+
+unsafe impl GlobalAlloc for CountingAllocator {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        let current = CURRENT.fetch_add(layout.size(), Ordering::SeqCst) + layout.size();
+        PEAK.fetch_max(current, Ordering::SeqCst);
+        System.alloc(layout)
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        CURRENT.fetch_sub(layout.size(), Ordering::SeqCst);
+        System.dealloc(ptr, layout)
+    }
+}
+
+#[global_allocator]
+static ALLOCATOR: CountingAllocator = CountingAllocator;
+
+fn main() {
+    let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+    // build a large synthetic index
+    let mut ndjson = String::new();
+    for i in 0..ENTRIES {
+        ndjson += &format!(
+            "{{\"path\":\"some/deep/directory/file-{}\",\"hash\":\"{:040x}\"}}\n",
+            i, i
+        );
+    }
+    let index = Index::load_ndjson(ndjson.as_bytes(), &dir).expect("unable to load index");
+    drop(ndjson);
+
+    let baseline = CURRENT.load(Ordering::SeqCst);
+    PEAK.store(baseline, Ordering::SeqCst);
+
+    let start = Instant::now();
+    index.save().expect("unable to save index");
+    let elapsed = start.elapsed();
+
+    let peak = PEAK.load(Ordering::SeqCst) - baseline;
+    println!(
+        "save: {} entries in {:?}, peak memory {} KiB ({} bytes/entry)",
+        ENTRIES,
+        elapsed,
+        peak / 1024,
+        peak / ENTRIES
+    );
+}
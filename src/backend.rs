@@ -0,0 +1,215 @@
+use std::fs;
+use std::fs::File;
+use std::io;
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+
+use crate::index::INDEX_FILE;
+
+/// The name of the temporary file the index is written to before replacing the index file.
+pub const TEMP_INDEX_FILE: &str = ".osync.tmp";
+
+/// A storage for the index files, so that the index of a directory
+/// can live elsewhere than in the directory itself (f.e in a database).
+pub trait Backend {
+    /// Returns a reader over the index of given directory,
+    /// or `None` if there's no index yet.
+    fn read_index(&self, directory: &Path) -> io::Result<Option<Box<dyn Read + '_>>>;
+
+    /// Returns a writer replacing the index of given directory.
+    /// The index is completely written once the writer has been committed.
+    fn write_index(&self, directory: &Path) -> io::Result<Box<dyn IndexWriter + '_>>;
+}
+
+/// A writer replacing the index of a directory.
+pub trait IndexWriter: Write {
+    /// Complete the write, replacing the previous index (if any).
+    fn commit(self: Box<Self>) -> io::Result<()>;
+}
+
+/// The default backend, storing the index as a file in the indexed directory.
+/// The index is written to a temporary file which replaces the index file once committed,
+/// so that the previous index is left intact if the write fails or is aborted.
+pub struct FsBackend;
+
+/// A writer to the temporary index file, renamed as the index file when committed
+/// and removed if dropped before.
+struct AtomicWriter {
+    file: File,
+    temp_path: PathBuf,
+    path: PathBuf,
+    committed: bool,
+}
+
+impl Write for AtomicWriter {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.file.write(buf)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.file.flush()
+    }
+}
+
+impl IndexWriter for AtomicWriter {
+    fn commit(mut self: Box<Self>) -> io::Result<()> {
+        // make sure the content is on the disk before replacing the index file
+        self.file.flush()?;
+        self.file.sync_all()?;
+        fs::rename(&self.temp_path, &self.path)?;
+        self.committed = true;
+        Ok(())
+    }
+}
+
+impl Drop for AtomicWriter {
+    fn drop(&mut self) {
+        if !self.committed {
+            let _ = fs::remove_file(&self.temp_path);
+        }
+    }
+}
+
+impl Backend for FsBackend {
+    fn read_index(&self, directory: &Path) -> io::Result<Option<Box<dyn Read + '_>>> {
+        match File::open(directory.join(INDEX_FILE)) {
+            Ok(file) => Ok(Some(Box::new(file))),
+            Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(None),
+            Err(e) => Err(e),
+        }
+    }
+
+    fn write_index(&self, directory: &Path) -> io::Result<Box<dyn IndexWriter + '_>> {
+        let temp_path = directory.join(TEMP_INDEX_FILE);
+        Ok(Box::new(AtomicWriter {
+            file: File::create(&temp_path)?,
+            temp_path,
+            path: directory.join(INDEX_FILE),
+            committed: false,
+        }))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::cell::RefCell;
+    use std::collections::HashMap;
+    use std::fs;
+    use std::io;
+    use std::io::{Read, Write};
+    use std::path::{Path, PathBuf};
+
+    use tempdir::TempDir;
+
+    use crate::backend::{Backend, FsBackend, IndexWriter, TEMP_INDEX_FILE};
+    use crate::index::{Index, SaveOptions, INDEX_FILE};
+
+    #[derive(Default)]
+    struct MemoryBackend {
+        indexes: RefCell<HashMap<PathBuf, Vec<u8>>>,
+    }
+
+    struct MemoryWriter<'a> {
+        backend: &'a MemoryBackend,
+        directory: PathBuf,
+        content: Vec<u8>,
+    }
+
+    impl Write for MemoryWriter<'_> {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            self.content.write(buf)
+        }
+
+        fn flush(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+    }
+
+    impl IndexWriter for MemoryWriter<'_> {
+        fn commit(self: Box<Self>) -> io::Result<()> {
+            self.backend
+                .indexes
+                .borrow_mut()
+                .insert(self.directory.clone(), self.content.clone());
+            Ok(())
+        }
+    }
+
+    impl Backend for MemoryBackend {
+        fn read_index(&self, directory: &Path) -> io::Result<Option<Box<dyn Read + '_>>> {
+            Ok(self
+                .indexes
+                .borrow()
+                .get(directory)
+                .map(|content| Box::new(io::Cursor::new(content.clone())) as Box<dyn Read>))
+        }
+
+        fn write_index(&self, directory: &Path) -> io::Result<Box<dyn IndexWriter + '_>> {
+            Ok(Box::new(MemoryWriter {
+                backend: self,
+                directory: directory.to_path_buf(),
+                content: Vec::new(),
+            }))
+        }
+    }
+
+    #[test]
+    fn test_memory_backend() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let backend = MemoryBackend::default();
+
+        // no index yet
+        let index = Index::load_from_backend(&backend, &dir).expect("unable to load index");
+        assert!(index.is_empty());
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index
+            .save_to_backend(&backend, &SaveOptions::new())
+            .expect("unable to save index");
+        assert!(!dir.path().join(INDEX_FILE).exists());
+
+        let loaded = Index::load_from_backend(&backend, &dir).expect("unable to load index");
+        assert_eq!(loaded.files(), index.files());
+    }
+
+    #[test]
+    fn test_fs_backend_commit() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join(INDEX_FILE), "previous").expect("unable to write index");
+
+        // the index is only replaced once committed
+        let mut writer = FsBackend
+            .write_index(dir.path())
+            .expect("unable to write index");
+        writer.write_all(b"current").expect("unable to write index");
+        writer.flush().expect("unable to flush index");
+        writer.flush().expect("unable to flush index");
+        assert_eq!(
+            fs::read_to_string(dir.path().join(INDEX_FILE)).expect("unable to read index"),
+            "previous"
+        );
+
+        writer.commit().expect("unable to commit index");
+        assert_eq!(
+            fs::read_to_string(dir.path().join(INDEX_FILE)).expect("unable to read index"),
+            "current"
+        );
+        assert!(!dir.path().join(TEMP_INDEX_FILE).exists());
+
+        // the temporary file is removed if the writer is not committed
+        let mut writer = FsBackend
+            .write_index(dir.path())
+            .expect("unable to write index");
+        writer.write_all(b"aborted").expect("unable to write index");
+        drop(writer);
+        assert_eq!(
+            fs::read_to_string(dir.path().join(INDEX_FILE)).expect("unable to read index"),
+            "current"
+        );
+        assert!(!dir.path().join(TEMP_INDEX_FILE).exists());
+    }
+}
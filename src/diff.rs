@@ -0,0 +1,793 @@
+use std::collections::{BTreeSet, HashMap, HashSet};
+use std::error::Error;
+use std::io;
+use std::io::Write;
+use std::path::Path;
+
+use serde::Serialize;
+
+use crate::index::Index;
+
+/// The result of a diff between two indexes.
+/// The added, modified & deleted files are computed once, when the result
+/// is created, so that they can be queried many times without any cost.
+pub struct DiffResult {
+    added: Vec<String>,
+    modified: Vec<String>,
+    deleted: Vec<String>,
+    renamed: Vec<(String, String)>,
+    conflicts: Vec<String>,
+}
+
+/// The JSON summary of a diff.
+#[derive(Serialize)]
+struct JsonSummary<'a> {
+    added: &'a [String],
+    modified: &'a [String],
+    deleted: &'a [String],
+    renamed: Vec<JsonRename<'a>>,
+    counts: JsonCounts,
+}
+
+#[derive(Serialize)]
+struct JsonRename<'a> {
+    from: &'a str,
+    to: &'a str,
+}
+
+#[derive(Serialize)]
+struct JsonCounts {
+    added: usize,
+    modified: usize,
+    deleted: usize,
+    renamed: usize,
+}
+
+// the ANSI escape codes used to color the report
+const GREEN: &str = "\x1b[32m";
+const YELLOW: &str = "\x1b[33m";
+const RED: &str = "\x1b[31m";
+const CYAN: &str = "\x1b[36m";
+const RESET: &str = "\x1b[0m";
+
+impl DiffResult {
+    /// Compute the difference between the indexes a & b.
+    pub fn new(a: &Index, b: &Index) -> DiffResult {
+        let mut added: Vec<String> = Vec::new();
+        let mut modified: Vec<String> = Vec::new();
+        let mut deleted: Vec<String> = Vec::new();
+
+        for (path, hash) in b.files() {
+            match a.files().get(path) {
+                None => added.push(path.to_string()),
+                Some(previous_hash) if previous_hash != hash => modified.push(path.to_string()),
+                _ => {}
+            }
+        }
+
+        for path in a.files().keys() {
+            if !b.files().contains_key(path) {
+                deleted.push(path.to_string());
+            }
+        }
+
+        // the conflicting keys of both indexes
+        let mut conflicts: Vec<String> = a.conflicts().to_vec();
+        conflicts.extend_from_slice(b.conflicts());
+
+        added.sort();
+        modified.sort();
+        deleted.sort();
+        conflicts.sort();
+        conflicts.dedup();
+
+        // a deleted file whose content has been added under another path has been renamed
+        let mut added_by_hash: HashMap<&String, Vec<&String>> = HashMap::new();
+        for path in added.iter().rev() {
+            added_by_hash
+                .entry(&b.files()[path])
+                .or_default()
+                .push(path);
+        }
+        let mut renamed: Vec<(String, String)> = Vec::new();
+        for from in &deleted {
+            if let Some(to) = added_by_hash
+                .get_mut(&a.files()[from])
+                .and_then(|p| p.pop())
+            {
+                renamed.push((from.to_string(), to.to_string()));
+            }
+        }
+
+        DiffResult {
+            added,
+            modified,
+            deleted,
+            renamed,
+            conflicts,
+        }
+    }
+
+    /// Returns the files present in b but not in a.
+    pub fn added(&self) -> &[String] {
+        &self.added
+    }
+
+    /// Returns the files present in both indexes with a different content.
+    pub fn modified(&self) -> &[String] {
+        &self.modified
+    }
+
+    /// Returns the files present in a but not in b.
+    pub fn deleted(&self) -> &[String] {
+        &self.deleted
+    }
+
+    /// Returns the files of a (deleted) found with the same content under
+    /// another path of b (added), as (from, to) pairs.
+    /// The renamed files are also part of the added & deleted files.
+    pub fn renamed(&self) -> &[(String, String)] {
+        &self.renamed
+    }
+
+    /// Returns the keys shared by many files in one of the indexes
+    /// (f.e because of Unicode normalization), whose changes may be lost.
+    pub fn conflicts(&self) -> &[String] {
+        &self.conflicts
+    }
+
+    /// Returns `true` if there's no difference between the indexes.
+    pub fn is_empty(&self) -> bool {
+        self.added.is_empty() && self.modified.is_empty() && self.deleted.is_empty()
+    }
+
+    /// Returns the difference between the indexes b & a without computing it again:
+    /// the added & deleted files are swapped, and so are the renamed files.
+    pub fn reverse(&self) -> DiffResult {
+        let mut renamed: Vec<(String, String)> = self
+            .renamed
+            .iter()
+            .map(|(from, to)| (to.to_string(), from.to_string()))
+            .collect();
+        renamed.sort();
+
+        DiffResult {
+            added: self.deleted.clone(),
+            modified: self.modified.clone(),
+            deleted: self.added.clone(),
+            renamed,
+            conflicts: self.conflicts.clone(),
+        }
+    }
+
+    /// Returns the number of bytes to transfer from the source (indexed by b)
+    /// to apply the changes: the size of the added (including the renamed) & modified files.
+    /// The files whose size is unknown are not counted.
+    pub fn transfer_bytes(&self, b: &Index) -> u64 {
+        self.added
+            .iter()
+            .chain(&self.modified)
+            .filter_map(|path| b.metadata(path))
+            .map(|metadata| metadata.size)
+            .sum()
+    }
+
+    /// Returns the kind of change of each changed file, f.e for membership checks.
+    pub fn paths(&self) -> HashMap<String, ChangeType> {
+        let changes = [
+            (&self.added, ChangeType::Added),
+            (&self.modified, ChangeType::Modified),
+            (&self.deleted, ChangeType::Deleted),
+        ];
+
+        let mut paths: HashMap<String, ChangeType> = HashMap::new();
+        for (files, change) in changes.iter() {
+            for path in files.iter() {
+                paths.insert(path.to_string(), *change);
+            }
+        }
+
+        paths
+    }
+
+    /// Write a human-readable report of the changes to given writer:
+    /// one section per kind of change with the number of files and their paths,
+    /// the renamed files being only reported as such.
+    /// The sections are colored using ANSI escape codes if `color` is `true`.
+    pub fn report<W: Write>(&self, w: &mut W, color: bool) -> io::Result<()> {
+        let renamed_from: HashSet<&String> = self.renamed.iter().map(|(from, _)| from).collect();
+        let renamed_to: HashSet<&String> = self.renamed.iter().map(|(_, to)| to).collect();
+
+        let added: Vec<String> = self
+            .added
+            .iter()
+            .filter(|path| !renamed_to.contains(path))
+            .cloned()
+            .collect();
+        let deleted: Vec<String> = self
+            .deleted
+            .iter()
+            .filter(|path| !renamed_from.contains(path))
+            .cloned()
+            .collect();
+        let renamed: Vec<String> = self
+            .renamed
+            .iter()
+            .map(|(from, to)| format!("{} -> {}", from, to))
+            .collect();
+
+        let sections = [
+            ("Added", '+', GREEN, &added),
+            ("Modified", '~', YELLOW, &self.modified),
+            ("Deleted", '-', RED, &deleted),
+            ("Renamed", '>', CYAN, &renamed),
+        ];
+        for (title, symbol, code, paths) in sections.iter() {
+            let (start, end) = if color { (*code, RESET) } else { ("", "") };
+            writeln!(w, "{}{} ({}):{}", start, title, paths.len(), end)?;
+            for path in paths.iter() {
+                writeln!(w, "  {}{} {}{}", start, symbol, path, end)?;
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Write a JSON document summarizing the changes to given writer,
+    /// with the added, modified, deleted & renamed files and their counts.
+    pub fn write_json<W: Write>(&self, w: W) -> Result<(), Box<dyn Error>> {
+        let summary = JsonSummary {
+            added: &self.added,
+            modified: &self.modified,
+            deleted: &self.deleted,
+            renamed: self
+                .renamed
+                .iter()
+                .map(|(from, to)| JsonRename { from, to })
+                .collect(),
+            counts: JsonCounts {
+                added: self.added.len(),
+                modified: self.modified.len(),
+                deleted: self.deleted.len(),
+                renamed: self.renamed.len(),
+            },
+        };
+
+        serde_json::to_writer(w, &summary).map_err(|e| e.into())
+    }
+
+    /// Write a shell script of `cp` & `rm` commands to given writer, which makes
+    /// the target directory (indexed by a) match the source directory (indexed by b):
+    /// the added & modified files are copied and the deleted files are removed.
+    pub fn shell_script<W: Write>(
+        &self,
+        source: &Path,
+        target: &Path,
+        w: &mut W,
+    ) -> io::Result<()> {
+        writeln!(w, "#!/bin/sh")?;
+        writeln!(w, "set -e")?;
+
+        let mut copies: Vec<&String> = self.added.iter().chain(&self.modified).collect();
+        copies.sort();
+
+        let mut directories: HashSet<&str> = HashSet::new();
+        for path in copies {
+            if let Some((directory, _)) = path.rsplit_once('/') {
+                if directories.insert(directory) {
+                    writeln!(w, "mkdir -p {}", shell_quote(&target.join(directory)))?;
+                }
+            }
+            writeln!(
+                w,
+                "cp {} {}",
+                shell_quote(&source.join(path)),
+                shell_quote(&target.join(path))
+            )?;
+        }
+
+        for path in &self.deleted {
+            writeln!(w, "rm {}", shell_quote(&target.join(path)))?;
+        }
+
+        Ok(())
+    }
+
+    /// Returns the number of changes (additions, modifications & deletions)
+    /// per directory, keeping the first `depth` components of the paths.
+    /// The changes of the files located above `depth` are counted in their
+    /// own directory, the root being an empty string.
+    pub fn by_directory(&self, depth: usize) -> HashMap<String, usize> {
+        let mut changes: HashMap<String, usize> = HashMap::new();
+
+        for path in self.added.iter().chain(&self.modified).chain(&self.deleted) {
+            let components: Vec<&str> = path.split('/').collect();
+            // the last component is the file name
+            let depth = depth.min(components.len() - 1);
+            *changes.entry(components[..depth].join("/")).or_insert(0) += 1;
+        }
+
+        changes
+    }
+}
+
+/// The kind of change of a file between two indexes.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ChangeType {
+    Added,
+    Modified,
+    Deleted,
+}
+
+/// Returns given path quoted for a POSIX shell.
+fn shell_quote(path: &Path) -> String {
+    format!("'{}'", path.to_string_lossy().replace('\'', "'\\''"))
+}
+
+/// An operation to apply to a mirror so that it matches its source.
+#[derive(Debug, PartialEq)]
+pub enum Operation {
+    /// Copy the file from the source, overwriting the mirror one (if any).
+    Copy(String),
+    /// Delete the file from the mirror.
+    Delete(String),
+}
+
+/// The operations needed to make a mirror match its source (one-way sync):
+/// the files added or modified in the source are copied, and the files
+/// only present in the mirror are deleted.
+pub struct MirrorDiff {
+    operations: Vec<Operation>,
+}
+
+impl MirrorDiff {
+    /// Compute the operations to apply to the mirror (indexed by a) to match the source (b).
+    pub fn new(a: &Index, b: &Index) -> MirrorDiff {
+        let result = DiffResult::new(a, b);
+
+        let mut copies: Vec<&String> = result.added.iter().chain(&result.modified).collect();
+        copies.sort();
+
+        // the copies come first so that an interrupted sync never loses a file
+        // which is still to be copied to a new location
+        let operations = copies
+            .into_iter()
+            .map(|path| Operation::Copy(path.to_string()))
+            .chain(
+                result
+                    .deleted
+                    .iter()
+                    .map(|path| Operation::Delete(path.to_string())),
+            )
+            .collect();
+
+        MirrorDiff { operations }
+    }
+
+    /// Returns the operations to apply, the copies being before the deletions.
+    pub fn operations(&self) -> &[Operation] {
+        &self.operations
+    }
+
+    /// Returns `true` if the mirror already matches its source.
+    pub fn is_empty(&self) -> bool {
+        self.operations.is_empty()
+    }
+}
+
+/// The result of a three-way diff between a common base index and two indexes
+/// derived from it, used to reconcile both sides of a bidirectional sync.
+/// A path is changed if it has been added, modified or deleted since the base.
+pub struct ThreeWayResult {
+    unchanged: Vec<String>,
+    changed_a: Vec<String>,
+    changed_b: Vec<String>,
+    conflicting: Vec<String>,
+}
+
+impl ThreeWayResult {
+    /// Compute the three-way difference between the indexes a & b and their common base.
+    /// The paths changed the same way on both sides are considered unchanged
+    /// since both sides agree on their content.
+    pub fn new(base: &Index, a: &Index, b: &Index) -> ThreeWayResult {
+        let mut unchanged: Vec<String> = Vec::new();
+        let mut changed_a: Vec<String> = Vec::new();
+        let mut changed_b: Vec<String> = Vec::new();
+        let mut conflicting: Vec<String> = Vec::new();
+
+        let paths: BTreeSet<&String> = base
+            .files()
+            .keys()
+            .chain(a.files().keys())
+            .chain(b.files().keys())
+            .collect();
+
+        for path in paths {
+            let base_hash = base.files().get(path);
+            let a_hash = a.files().get(path);
+            let b_hash = b.files().get(path);
+
+            let result = if a_hash == b_hash {
+                &mut unchanged
+            } else if a_hash == base_hash {
+                &mut changed_b
+            } else if b_hash == base_hash {
+                &mut changed_a
+            } else {
+                &mut conflicting
+            };
+            result.push(path.to_string());
+        }
+
+        ThreeWayResult {
+            unchanged,
+            changed_a,
+            changed_b,
+            conflicting,
+        }
+    }
+
+    /// Returns the files with the same content in both indexes.
+    pub fn unchanged(&self) -> &[String] {
+        &self.unchanged
+    }
+
+    /// Returns the files only changed in a.
+    pub fn changed_a(&self) -> &[String] {
+        &self.changed_a
+    }
+
+    /// Returns the files only changed in b.
+    pub fn changed_b(&self) -> &[String] {
+        &self.changed_b
+    }
+
+    /// Returns the files changed differently in both indexes.
+    pub fn conflicting(&self) -> &[String] {
+        &self.conflicting
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+    use std::fs;
+    use std::path::Path;
+
+    use tempdir::TempDir;
+
+    use crate::diff::{ChangeType, MirrorDiff, Operation, ThreeWayResult};
+    use crate::index::{ComputeOptions, Index, Normalization};
+
+    #[test]
+    fn test_diff_result() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("unchanged"), "hello").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("deleted")).expect("unable to remove test file");
+        fs::write(dir.path().join("added"), "hello").expect("unable to write test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let result = previous_index.diff_result(&current_index);
+        assert_eq!(result.added(), ["added"]);
+        assert_eq!(result.modified(), ["modified"]);
+        assert_eq!(result.deleted(), ["deleted"]);
+        assert!(!result.is_empty());
+
+        // the changes are computed once, they don't depend on the indexes anymore
+        drop(previous_index);
+        drop(current_index);
+        fs::write(dir.path().join("unchanged"), "world").expect("unable to write test file");
+        assert_eq!(result.added(), ["added"]);
+        assert_eq!(result.modified(), ["modified"]);
+        assert_eq!(result.deleted(), ["deleted"]);
+    }
+
+    #[test]
+    fn test_diff_result_reverse() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("from"), "moved").expect("unable to write test file");
+
+        let (a, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("deleted")).expect("unable to remove test file");
+        fs::write(dir.path().join("added"), "hello").expect("unable to write test file");
+        fs::rename(dir.path().join("from"), dir.path().join("to")).expect("unable to rename");
+
+        let (b, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let result = a.diff_result(&b);
+        let reversed = result.reverse();
+        let expected = b.diff_result(&a);
+        assert_eq!(reversed.added(), expected.added());
+        assert_eq!(reversed.modified(), expected.modified());
+        assert_eq!(reversed.deleted(), expected.deleted());
+        assert_eq!(reversed.renamed(), expected.renamed());
+
+        let twice = reversed.reverse();
+        assert_eq!(twice.added(), result.added());
+        assert_eq!(twice.modified(), result.modified());
+        assert_eq!(twice.deleted(), result.deleted());
+        assert_eq!(twice.renamed(), result.renamed());
+    }
+
+    #[test]
+    fn test_diff_result_report() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("from"), "foo").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("deleted")).expect("unable to remove test file");
+        fs::rename(dir.path().join("from"), dir.path().join("to"))
+            .expect("unable to rename test file");
+        fs::write(dir.path().join("added"), "bar").expect("unable to write test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let result = previous_index.diff_result(&current_index);
+        assert_eq!(result.renamed(), [("from".to_string(), "to".to_string())]);
+
+        let mut report = Vec::new();
+        result
+            .report(&mut report, false)
+            .expect("unable to write report");
+        assert_eq!(
+            String::from_utf8(report).unwrap(),
+            "Added (1):\n  + added\n\
+             Modified (1):\n  ~ modified\n\
+             Deleted (1):\n  - deleted\n\
+             Renamed (1):\n  > from -> to\n"
+        );
+
+        let mut report = Vec::new();
+        result
+            .report(&mut report, true)
+            .expect("unable to write report");
+        let report = String::from_utf8(report).unwrap();
+        assert!(report.starts_with("\x1b[32mAdded (1):\x1b[0m\n"));
+    }
+
+    #[test]
+    fn test_diff_result_transfer_bytes() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("unchanged"), vec![0; 1000]).expect("unable to write test file");
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("from"), "foo").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "hello world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("deleted")).expect("unable to remove test file");
+        fs::rename(dir.path().join("from"), dir.path().join("to"))
+            .expect("unable to rename test file");
+        fs::write(dir.path().join("added"), vec![0; 100]).expect("unable to write test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let result = previous_index.diff_result(&current_index);
+        assert_eq!(result.transfer_bytes(&current_index), 11 + 3 + 100);
+    }
+
+    #[test]
+    fn test_diff_paths() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("unchanged"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted"), "hello").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("added"), "world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("deleted")).expect("unable to remove test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let paths = previous_index.diff_paths(&current_index);
+        assert_eq!(paths.len(), 3);
+        assert_eq!(paths["added"], ChangeType::Added);
+        assert_eq!(paths["modified"], ChangeType::Modified);
+        assert_eq!(paths["deleted"], ChangeType::Deleted);
+        assert!(!paths.contains_key("unchanged"));
+    }
+
+    #[test]
+    fn test_diff_result_shell_script() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub dir")).expect("unable to create dir");
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("it's deleted"), "hello").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("it's deleted")).expect("unable to remove test file");
+        fs::write(dir.path().join("sub dir").join("new file"), "world")
+            .expect("unable to write test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let mut script = Vec::new();
+        previous_index
+            .diff_result(&current_index)
+            .shell_script(Path::new("/src"), Path::new("/dst"), &mut script)
+            .expect("unable to write script");
+        assert_eq!(
+            String::from_utf8(script).unwrap(),
+            "#!/bin/sh\nset -e\n\
+             cp '/src/modified' '/dst/modified'\n\
+             mkdir -p '/dst/sub dir'\n\
+             cp '/src/sub dir/new file' '/dst/sub dir/new file'\n\
+             rm '/dst/it'\\''s deleted'\n"
+        );
+    }
+
+    #[test]
+    fn test_diff_summary_json() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("from"), "foo").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "world").expect("unable to write test file");
+        fs::rename(dir.path().join("from"), dir.path().join("to"))
+            .expect("unable to rename test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let mut buf: Vec<u8> = Vec::new();
+        previous_index
+            .diff_summary_json(&current_index, &mut buf)
+            .expect("unable to write summary");
+
+        let summary: serde_json::Value =
+            serde_json::from_slice(&buf).expect("unable to parse summary");
+        assert_eq!(summary["added"], serde_json::json!(["to"]));
+        assert_eq!(summary["modified"], serde_json::json!(["modified"]));
+        assert_eq!(summary["deleted"], serde_json::json!(["from"]));
+        assert_eq!(
+            summary["renamed"],
+            serde_json::json!([{"from": "from", "to": "to"}])
+        );
+        assert_eq!(summary["counts"]["modified"], 1);
+        assert_eq!(summary["counts"]["renamed"], 1);
+    }
+
+    #[test]
+    fn test_diff_result_by_directory() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir_all(dir.path().join("src").join("sub")).expect("unable to create dir");
+        fs::create_dir(dir.path().join("docs")).expect("unable to create dir");
+        fs::write(dir.path().join("src").join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("docs").join("b"), "hello").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("src").join("a"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("src").join("sub").join("c"), "hello")
+            .expect("unable to write test file");
+        fs::remove_file(dir.path().join("docs").join("b")).expect("unable to remove test file");
+        fs::write(dir.path().join("README"), "hello").expect("unable to write test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let result = previous_index.diff_result(&current_index);
+
+        let mut expected = HashMap::new();
+        expected.insert("src".to_string(), 2);
+        expected.insert("docs".to_string(), 1);
+        expected.insert("".to_string(), 1);
+        assert_eq!(result.by_directory(1), expected);
+
+        let mut expected = HashMap::new();
+        expected.insert("".to_string(), 4);
+        assert_eq!(result.by_directory(0), expected);
+    }
+
+    #[test]
+    fn test_diff_result_conflicts() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("Caf\u{e9}"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("Cafe\u{301}"), "world").expect("unable to write test file");
+
+        let options = ComputeOptions::new().normalization(Normalization::Nfc);
+        let (current_index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(current_index.len(), 1);
+
+        let result = previous_index.diff_result(&current_index);
+        assert_eq!(result.added(), ["Caf\u{e9}"]);
+        assert_eq!(result.conflicts(), ["Caf\u{e9}"]);
+    }
+
+    #[test]
+    fn test_three_way_result() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("unchanged"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("changed_a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("changed_b"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("conflicting"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted_b"), "hello").expect("unable to write test file");
+
+        let (base, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("changed_a"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("conflicting"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("added_a"), "hello").expect("unable to write test file");
+
+        let (a, _) = Index::compute(&dir).expect("unable to compute index");
+
+        // restore the base files changed in a
+        fs::write(dir.path().join("changed_a"), "hello").expect("unable to write test file");
+        fs::remove_file(dir.path().join("added_a")).expect("unable to remove test file");
+
+        fs::write(dir.path().join("changed_b"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("conflicting"), "foo").expect("unable to write test file");
+        fs::remove_file(dir.path().join("deleted_b")).expect("unable to remove test file");
+
+        let (b, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let result = ThreeWayResult::new(&base, &a, &b);
+        assert_eq!(result.unchanged(), ["unchanged"]);
+        assert_eq!(result.changed_a(), ["added_a", "changed_a"]);
+        assert_eq!(result.changed_b(), ["changed_b", "deleted_b"]);
+        assert_eq!(result.conflicting(), ["conflicting"]);
+    }
+
+    #[test]
+    fn test_mirror_diff() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("unchanged"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("extra"), "hello").expect("unable to write test file");
+
+        let (mirror, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("added"), "world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("extra")).expect("unable to remove test file");
+
+        let (source, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let result = MirrorDiff::new(&mirror, &source);
+        assert_eq!(
+            result.operations(),
+            [
+                Operation::Copy("added".to_string()),
+                Operation::Copy("modified".to_string()),
+                Operation::Delete("extra".to_string()),
+            ]
+        );
+        assert!(!result.is_empty());
+
+        assert!(mirror.mirror_diff(&mirror).is_empty());
+    }
+}
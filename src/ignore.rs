@@ -0,0 +1,152 @@
+use std::error::Error;
+use std::path::Path;
+
+use globset::{Glob, GlobBuilder, GlobMatcher};
+
+use crate::index::read_ignore_file;
+
+/// The name of the git ignore files.
+pub const GITIGNORE_FILE: &str = ".gitignore";
+
+/// A single pattern from a .gitignore file.
+struct Rule {
+    matcher: GlobMatcher,
+    negate: bool,
+    dir_only: bool,
+}
+
+/// A set of .gitignore patterns, following the git semantics:
+/// the last matching pattern wins and patterns are relative to
+/// the directory containing the .gitignore file.
+#[derive(Default)]
+pub struct GitIgnore {
+    rules: Vec<Rule>,
+}
+
+impl GitIgnore {
+    pub fn new() -> GitIgnore {
+        GitIgnore::default()
+    }
+
+    /// Add the patterns of a .gitignore file located in the directory `base`
+    /// (relative to the root of the tree, empty for the root itself).
+    /// Invalid patterns are skipped, like git does.
+    pub fn add(&mut self, base: &str, content: &str) {
+        for line in content.lines() {
+            let line = line.trim_end();
+
+            // skip blank lines & comments
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+
+            let (negate, pattern) = match line.strip_prefix('!') {
+                Some(pattern) => (true, pattern),
+                None => (false, line.strip_prefix('\\').unwrap_or(line)),
+            };
+
+            let (dir_only, pattern) = match pattern.strip_suffix('/') {
+                Some(pattern) => (true, pattern),
+                None => (false, pattern),
+            };
+
+            // a pattern without slash matches at any level below base
+            // otherwise it is relative to base
+            let pattern = if pattern.contains('/') {
+                pattern.trim_start_matches('/').to_string()
+            } else {
+                format!("**/{}", pattern)
+            };
+            let pattern = if base.is_empty() {
+                pattern
+            } else {
+                format!("{}/{}", base, pattern)
+            };
+
+            if let Ok(glob) = GlobBuilder::new(&pattern).literal_separator(true).build() {
+                self.rules.push(Rule {
+                    matcher: glob.compile_matcher(),
+                    negate,
+                    dir_only,
+                });
+            }
+        }
+    }
+
+    /// Returns `true` if given path (relative to the root of the tree) is ignored.
+    pub fn is_ignored(&self, path: &str, is_dir: bool) -> bool {
+        let mut ignored = false;
+        for rule in &self.rules {
+            if rule.dir_only && !is_dir {
+                continue;
+            }
+            if rule.matcher.is_match(path) {
+                ignored = !rule.negate;
+            }
+        }
+
+        ignored
+    }
+}
+
+/// Check the patterns of the .osyncignore file of given directory
+/// return the syntactically invalid ones (f.e `[abc`).
+pub fn validate_ignore_file<P: AsRef<Path>>(directory: P) -> Result<Vec<String>, Box<dyn Error>> {
+    let patterns = match read_ignore_file(directory.as_ref())? {
+        Some((_, patterns)) => patterns,
+        None => return Ok(Vec::new()),
+    };
+
+    Ok(patterns
+        .into_iter()
+        .filter(|pattern| Glob::new(pattern).is_err())
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+
+    use tempdir::TempDir;
+
+    use crate::ignore::{validate_ignore_file, GitIgnore};
+
+    #[test]
+    fn test_gitignore() {
+        let mut gitignore = GitIgnore::new();
+        gitignore.add("", "# comment\n\nbuild/\n*.log\n!keep.log\n/root-only\n");
+        gitignore.add("sub", "local\n");
+
+        assert!(gitignore.is_ignored("build", true));
+        assert!(gitignore.is_ignored("deep/build", true));
+        assert!(!gitignore.is_ignored("build", false));
+
+        assert!(gitignore.is_ignored("test.log", false));
+        assert!(gitignore.is_ignored("deep/test.log", false));
+        assert!(!gitignore.is_ignored("keep.log", false));
+
+        assert!(gitignore.is_ignored("root-only", false));
+        assert!(!gitignore.is_ignored("deep/root-only", false));
+
+        assert!(gitignore.is_ignored("sub/local", false));
+        assert!(!gitignore.is_ignored("local", false));
+    }
+
+    #[test]
+    fn test_validate_ignore_file() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        // no ignore file
+        let invalid = validate_ignore_file(&dir).expect("unable to validate ignore file");
+        assert!(invalid.is_empty());
+
+        fs::write(
+            dir.path().join(".osyncignore"),
+            "valid\n*.log\nbuild/\n[abc\n{a,b\n",
+        )
+        .expect("unable to write ignore file");
+        let invalid = validate_ignore_file(&dir).expect("unable to validate ignore file");
+        // the valid glob patterns are not reported
+        assert_eq!(invalid, ["[abc", "{a,b"]);
+    }
+}
@@ -1,19 +1,872 @@
-use std::collections::HashMap;
+use std::borrow::Cow;
+use std::cell::RefCell;
+use std::cmp::Reverse;
+use std::collections::{BTreeSet, HashMap, HashSet};
+use std::env;
 use std::error::Error;
+use std::fmt;
 use std::fs;
 use std::fs::File;
-use std::io::{BufRead, BufReader, Write};
-use std::path::{Path, PathBuf};
+use std::io;
+use std::io::{BufRead, BufReader, BufWriter, Read, Write};
+use std::path::{Component, Path, PathBuf, MAIN_SEPARATOR};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::mpsc;
+use std::sync::mpsc::Receiver;
+use std::sync::Arc;
+use std::thread;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
 
+use flate2::read::GzDecoder;
+use percent_encoding::{percent_decode_str, utf8_percent_encode, AsciiSet, CONTROLS};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
 use sha1::Digest;
+use unicode_normalization::UnicodeNormalization;
 use walkdir::WalkDir;
 
-const INDEX_FILE: &str = ".osync";
+use crate::backend::{Backend, FsBackend, TEMP_INDEX_FILE};
+use crate::diff::{ChangeType, DiffResult, MirrorDiff};
+use crate::ignore::{GitIgnore, GITIGNORE_FILE};
+use crate::lock::LOCK_FILE;
+
+pub(crate) const INDEX_FILE: &str = ".osync";
 const IGNORE_FILE: &str = ".osyncignore";
+// the gzipped ignore file, used when there's no plain one
+const GZIPPED_IGNORE_FILE: &str = ".osyncignore.gz";
+// the marker re-including a directory excluded by one of its parents
+const KEEP_FILE: &str = ".osynckeep";
+
+// the UTF-8 byte order mark some editors prepend to files
+const BOM: char = '\u{feff}';
+
+// the last line of the index file, holding the checksum of the preceding content
+const CHECKSUM_FOOTER: &str = "#checksum:";
+
+/// A single index entry, as serialized in the NDJSON format.
+#[derive(Serialize, Deserialize)]
+struct NdjsonEntry {
+    path: String,
+    hash: String,
+}
+
+/// The Unicode normalization forms which can be applied to the index keys.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Normalization {
+    /// Canonical composition, as typically used on Linux.
+    Nfc,
+    /// Canonical decomposition, as used by macOS.
+    Nfd,
+}
+
+impl Normalization {
+    fn apply(&self, path: &str) -> String {
+        match self {
+            Normalization::Nfc => path.nfc().collect(),
+            Normalization::Nfd => path.nfd().collect(),
+        }
+    }
+}
+
+/// How the empty files are indexed, instead of hashing them like any other file.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum EmptyFiles {
+    /// Do not index the empty files.
+    Skip,
+    /// Index the empty files with the `EMPTY_CHECKSUM` sentinel, without reading them.
+    Sentinel,
+}
+
+/// The checksum of the empty files when using `EmptyFiles::Sentinel`.
+pub const EMPTY_CHECKSUM: &str = "empty";
+
+/// Decide which files are ignored while computing an index.
+pub trait Matcher {
+    /// Returns `true` if the file at given (relative, slash separated) path should be ignored.
+    fn is_match(&self, path: &str) -> bool;
+}
+
+impl<F: Fn(&str) -> bool> Matcher for F {
+    fn is_match(&self, path: &str) -> bool {
+        self(path)
+    }
+}
+
+/// The default matcher, ignoring the files whose path is one of the patterns.
+struct ExactMatcher(HashSet<String>);
+
+impl Matcher for ExactMatcher {
+    fn is_match(&self, path: &str) -> bool {
+        self.0.contains(path)
+    }
+}
+
+type PathMapper = Box<dyn Fn(&str) -> String + Send + Sync>;
+type Decompressor = Box<dyn Fn(Box<dyn Read>) -> Box<dyn Read> + Send + Sync>;
+type Logger = Box<dyn Fn(&str) + Send + Sync>;
+type DirectoryCallback = Box<dyn Fn(&str, usize) + Send + Sync>;
+
+/// The name of the algorithm used by default to compute the checksums.
+pub const DEFAULT_ALGORITHM: &str = "sha1";
+
+/// The error returned when comparing indexes whose checksums
+/// have been computed using different algorithms (or with and without salt).
+#[derive(Debug)]
+pub struct AlgorithmMismatch {
+    a: String,
+    b: String,
+}
+
+impl fmt::Display for AlgorithmMismatch {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "algorithm mismatch: {} != {}", self.a, self.b)
+    }
+}
+
+impl Error for AlgorithmMismatch {}
+
+/// A hash function used to compute the checksum of the files.
+pub trait Hasher {
+    /// Feed given data to the hasher.
+    fn update(&mut self, data: &[u8]);
+
+    /// Consume the hasher and return the digest.
+    fn finalize(self: Box<Self>) -> Vec<u8>;
+}
+
+// The default SHA-1 hash function.
+struct Sha1Hasher(sha1::Sha1);
+
+impl Hasher for Sha1Hasher {
+    fn update(&mut self, data: &[u8]) {
+        self.0.update(data);
+    }
+
+    fn finalize(self: Box<Self>) -> Vec<u8> {
+        self.0.finalize().to_vec()
+    }
+}
+
+// the size of the buffer used to read the files while hashing them
+const DEFAULT_BUFFER_SIZE: usize = 8192;
+
+type HasherFactory = Box<dyn Fn() -> Box<dyn Hasher> + Send + Sync>;
+
+/// Options used to customize how an index is computed.
+#[derive(Default)]
+pub struct ComputeOptions {
+    path_mapper: Option<PathMapper>,
+    // decompress files with given extension before hashing them
+    decompressors: HashMap<String, Decompressor>,
+    follow_links: bool,
+    gitignore: bool,
+    path_in_digest: bool,
+    // the secret prepended to the content of the files before hashing them
+    salt: Option<String>,
+    xattrs: bool,
+    normalization: Option<Normalization>,
+    empty_files: Option<EmptyFiles>,
+    hard_links: bool,
+    // hash the content of the hard linked files once, indexing all their paths
+    inode_cache: bool,
+    canonical_paths: bool,
+    // skip the files whose relative path matches one of these
+    regex_excludes: Vec<Regex>,
+    // only index the files starting with one of these
+    magics: Vec<Vec<u8>>,
+    // walk the excluded directories looking for .osynckeep markers
+    keep_markers: bool,
+    // store the hash of the names of the children of each directory
+    directory_listings: bool,
+    // resolve the directory to its absolute, symlink-free path before walking it
+    real_root: bool,
+    // make the keys relative to the current directory instead of the walked one
+    cwd_relative: bool,
+    // skip the files modified less than this duration ago
+    grace_period: Option<Duration>,
+    // the maximum number of bytes read per second while hashing
+    rate_limit: Option<u64>,
+    // the size of the buffer used to read the files while hashing
+    buffer_size: Option<usize>,
+    // record when the index has been computed
+    record_time: bool,
+    // split the files into content-defined chunks of this average size
+    avg_chunk: Option<usize>,
+    // record when each path has been indexed for the first time
+    first_seen: bool,
+    // record the directories without any child
+    empty_directories: bool,
+    // skip this number of most recently modified files
+    exclude_newest: usize,
+    // skip the files having one of these inode numbers
+    #[cfg(unix)]
+    excluded_inodes: HashSet<u64>,
+    // only index the files owned by this user id
+    #[cfg(unix)]
+    owner: Option<u32>,
+    // the custom hash function to use and its label
+    hasher: Option<(String, HasherFactory)>,
+    // receive the diagnostics (f.e the skipped entries)
+    logger: Option<Logger>,
+    // called for each walked directory
+    on_directory: Option<DirectoryCallback>,
+    // the number of files read so far
+    #[cfg(test)]
+    reads: Option<Arc<std::sync::atomic::AtomicUsize>>,
+    // decide which files are ignored instead of the .osyncignore file
+    matcher: Option<Box<dyn Matcher + Send + Sync>>,
+}
+
+impl ComputeOptions {
+    /// Create the default options, which behave like `Index::compute`.
+    pub fn new() -> ComputeOptions {
+        ComputeOptions::default()
+    }
+
+    /// Rewrite each relative path before it is stored in the index.
+    /// If the mapper returns an empty string the file is skipped.
+    pub fn path_mapper<F>(mut self, mapper: F) -> ComputeOptions
+    where
+        F: Fn(&str) -> String + Send + Sync + 'static,
+    {
+        self.path_mapper = Some(Box::new(mapper));
+        self
+    }
+
+    /// Use given matcher instead of the patterns of the `.osyncignore` file
+    /// to decide which files are ignored. The index & ignore files are always ignored.
+    pub fn matcher<M>(mut self, matcher: M) -> ComputeOptions
+    where
+        M: Matcher + Send + Sync + 'static,
+    {
+        self.matcher = Some(Box::new(matcher));
+        self
+    }
+
+    /// Route the diagnostics emitted while computing the index (f.e the skipped entries)
+    /// to given function. They are discarded by default.
+    pub fn logger<F>(mut self, logger: F) -> ComputeOptions
+    where
+        F: Fn(&str) + Send + Sync + 'static,
+    {
+        self.logger = Some(Box::new(logger));
+        self
+    }
+
+    /// Call given function for each walked directory with its relative path
+    /// (an empty string being the root) and its number of children,
+    /// f.e to report the progress of the walk before the files are hashed.
+    pub fn on_directory<F>(mut self, callback: F) -> ComputeOptions
+    where
+        F: Fn(&str, usize) + Send + Sync + 'static,
+    {
+        self.on_directory = Some(Box::new(callback));
+        self
+    }
+
+    /// Follow symbolic links while walking the directory.
+    /// Links pointing to one of their ancestors are skipped to prevent infinite walks.
+    pub fn follow_links(mut self, follow_links: bool) -> ComputeOptions {
+        self.follow_links = follow_links;
+        self
+    }
+
+    /// Follow symbolic links and key the files by their canonical (resolved) path,
+    /// so that the same file reachable under many names is only indexed once.
+    /// Files resolving outside of the directory keep the path they were found at.
+    pub fn canonical_paths(mut self, canonical_paths: bool) -> ComputeOptions {
+        self.canonical_paths = canonical_paths;
+        self
+    }
+
+    /// Skip the files whose relative path matches one of given regular expressions.
+    /// This complements the patterns of the ignore files.
+    pub fn regex_excludes(mut self, patterns: &[Regex]) -> ComputeOptions {
+        self.regex_excludes.extend_from_slice(patterns);
+        self
+    }
+
+    /// Only index the files whose content starts with one of given magic bytes
+    /// (f.e the PNG or JPEG headers), the other files are skipped.
+    pub fn magics(mut self, magics: &[&[u8]]) -> ComputeOptions {
+        self.magics
+            .extend(magics.iter().map(|magic| magic.to_vec()));
+        self
+    }
+
+    /// Returns `true` if the file at given path should be indexed according to its magic bytes.
+    fn has_magic(&self, path: &Path) -> io::Result<bool> {
+        if self.magics.is_empty() {
+            return Ok(true);
+        }
+
+        let len = self
+            .magics
+            .iter()
+            .map(|magic| magic.len())
+            .max()
+            .unwrap_or(0);
+        let mut header = Vec::with_capacity(len);
+        File::open(path)?
+            .take(len as u64)
+            .read_to_end(&mut header)?;
+
+        Ok(self.magics.iter().any(|magic| header.starts_with(magic)))
+    }
+
+    /// Index the directories containing a `.osynckeep` file (and their content)
+    /// even if one of their parents is ignored. The ignored directories have to be
+    /// walked to look for the markers, which makes ignoring them less efficient.
+    pub fn keep_markers(mut self, keep_markers: bool) -> ComputeOptions {
+        self.keep_markers = keep_markers;
+        self
+    }
+
+    /// Store for each directory the hash of the names of its immediate children,
+    /// so that the directories where no file has been added or removed can be detected
+    /// without diffing their content (see `Index::listing`).
+    pub fn directory_listings(mut self, directory_listings: bool) -> ComputeOptions {
+        self.directory_listings = directory_listings;
+        self
+    }
+
+    /// Resolve the directory to its absolute, symlink-free path before walking it,
+    /// so that the index does not depend on how the directory was specified.
+    pub fn real_root(mut self, real_root: bool) -> ComputeOptions {
+        self.real_root = real_root;
+        self
+    }
+
+    /// Make the keys relative to the current working directory instead of the walked
+    /// directory (f.e `../dir/test`), for the tools expecting such paths.
+    /// `Index::abs_path` does not resolve these keys.
+    pub fn cwd_relative(mut self, cwd_relative: bool) -> ComputeOptions {
+        self.cwd_relative = cwd_relative;
+        self
+    }
+
+    /// Returns the directory to walk for given directory.
+    fn root(&self, directory: &Path) -> io::Result<PathBuf> {
+        if self.real_root {
+            fs::canonicalize(directory)
+        } else {
+            Ok(directory.to_path_buf())
+        }
+    }
+
+    /// Compute the checksums using the hash function created by given factory
+    /// instead of SHA-1. The label identifies the algorithm in the saved index.
+    pub fn hasher<F>(mut self, label: &str, factory: F) -> ComputeOptions
+    where
+        F: Fn() -> Box<dyn Hasher> + Send + Sync + 'static,
+    {
+        self.hasher = Some((label.to_string(), Box::new(factory)));
+        self
+    }
+
+    /// Returns the label of the algorithm used to compute the checksums.
+    fn algorithm(&self) -> &str {
+        match &self.hasher {
+            Some((label, _)) => label,
+            None => DEFAULT_ALGORITHM,
+        }
+    }
+
+    /// Returns a new instance of the hash function used to compute the checksums.
+    fn new_hasher(&self) -> Box<dyn Hasher> {
+        match &self.hasher {
+            Some((_, factory)) => factory(),
+            None => Box::new(Sha1Hasher(sha1::Sha1::new())),
+        }
+    }
+
+    /// Skip the files modified within given duration, to avoid indexing
+    /// files which are still being written.
+    pub fn grace_period(mut self, grace_period: Duration) -> ComputeOptions {
+        self.grace_period = Some(grace_period);
+        self
+    }
+
+    /// Limit the number of bytes read per second while hashing the files,
+    /// to avoid saturating the disk I/O.
+    pub fn rate_limit(mut self, bytes_per_second: u64) -> ComputeOptions {
+        self.rate_limit = Some(bytes_per_second);
+        self
+    }
+
+    /// Read the files using a buffer of given size (8 KiB by default) while hashing them.
+    /// A larger buffer reduces the number of reads on high-latency filesystems.
+    pub fn buffer_size(mut self, buffer_size: usize) -> ComputeOptions {
+        self.buffer_size = Some(buffer_size.max(1));
+        self
+    }
+
+    /// Record when the index has been computed (see `Index::computed_at`),
+    /// so that tools can warn about stale indexes. The saved index then
+    /// differs each time it is computed, even if the files did not change.
+    pub fn record_time(mut self, record_time: bool) -> ComputeOptions {
+        self.record_time = record_time;
+        self
+    }
+
+    /// Skip the given number of most recently modified files, f.e the ones being
+    /// written in bulk while the index is computed. Unlike `ComputeOptions::grace_period`
+    /// the directory is walked twice: once to find the newest files, then to index the others.
+    pub fn exclude_newest(mut self, n: usize) -> ComputeOptions {
+        self.exclude_newest = n;
+        self
+    }
+
+    /// Record when each path has been indexed for the first time (see `Index::first_seen`).
+    /// When computing an index incrementally the paths of the previous index keep
+    /// their original time, f.e to keep an audit trail.
+    pub fn first_seen(mut self, first_seen: bool) -> ComputeOptions {
+        self.first_seen = first_seen;
+        self
+    }
+
+    /// Record the directories without any child (see `Index::empty_directories`),
+    /// so that they can be created on the other side of a sync.
+    pub fn empty_directories(mut self, empty_directories: bool) -> ComputeOptions {
+        self.empty_directories = empty_directories;
+        self
+    }
+
+    /// Split each file into variable-length chunks of given average size whose boundaries
+    /// depend on the content (content-defined chunking), and store the checksum of
+    /// each chunk (see `Index::chunks`). Inserting bytes in a file only changes the chunks
+    /// around the insertion, so that only these have to be transferred.
+    pub fn chunking(mut self, avg_chunk: usize) -> ComputeOptions {
+        self.avg_chunk = Some(avg_chunk);
+        self
+    }
+
+    /// Skip the files having one of given inode numbers,
+    /// f.e the files already captured by an incremental backup.
+    #[cfg(unix)]
+    pub fn exclude_inodes(mut self, inodes: &HashSet<u64>) -> ComputeOptions {
+        self.excluded_inodes.extend(inodes);
+        self
+    }
+
+    /// Returns `true` if the file with given metadata should be skipped
+    /// because of its inode number.
+    #[cfg(unix)]
+    fn is_excluded_inode(&self, metadata: &fs::Metadata) -> bool {
+        use std::os::unix::fs::MetadataExt;
+
+        self.excluded_inodes.contains(&metadata.ino())
+    }
+
+    #[cfg(not(unix))]
+    fn is_excluded_inode(&self, _metadata: &fs::Metadata) -> bool {
+        false
+    }
+
+    /// Only index the files owned by given user id, the others are skipped.
+    #[cfg(unix)]
+    pub fn owner(mut self, uid: u32) -> ComputeOptions {
+        self.owner = Some(uid);
+        self
+    }
+
+    /// Only index the files owned by the user running the current process.
+    #[cfg(unix)]
+    pub fn owned_only(self) -> ComputeOptions {
+        self.owner(unsafe { libc::getuid() })
+    }
+
+    /// Returns `true` if the file with given metadata should be skipped
+    /// because it is not owned by the expected user.
+    #[cfg(unix)]
+    fn is_foreign(&self, metadata: &fs::Metadata) -> bool {
+        use std::os::unix::fs::MetadataExt;
+
+        matches!(self.owner, Some(uid) if metadata.uid() != uid)
+    }
+
+    #[cfg(not(unix))]
+    fn is_foreign(&self, _metadata: &fs::Metadata) -> bool {
+        false
+    }
+
+    /// Returns `true` if the file has been modified within the grace period.
+    fn is_recent(&self, metadata: &fs::Metadata) -> io::Result<bool> {
+        let grace_period = match self.grace_period {
+            Some(grace_period) => grace_period,
+            None => return Ok(false),
+        };
+
+        // a modification time in the future is considered recent
+        match metadata.modified()?.elapsed() {
+            Ok(elapsed) => Ok(elapsed < grace_period),
+            Err(_) => Ok(true),
+        }
+    }
+
+    /// Also honor the .gitignore files found in the tree.
+    pub fn gitignore(mut self, gitignore: bool) -> ComputeOptions {
+        self.gitignore = gitignore;
+        self
+    }
+
+    /// Include the relative path of the files in their digest,
+    /// so that moving a file changes its recorded checksum.
+    pub fn path_in_digest(mut self, path_in_digest: bool) -> ComputeOptions {
+        self.path_in_digest = path_in_digest;
+        self
+    }
+
+    /// Salt the digest of the files with given secret, so that a published index
+    /// cannot be compared against the checksums of known files.
+    /// Only the fact that the index is salted is recorded, not the secret itself,
+    /// which has to be supplied to verify the index (see `Index::verify_with_salt`).
+    pub fn salt(mut self, secret: &str) -> ComputeOptions {
+        self.salt = Some(secret.to_string());
+        self
+    }
 
+    /// Returns the bytes to hash before the content of the files (and of their chunks).
+    fn salt_prefix(&self) -> String {
+        match &self.salt {
+            Some(salt) => format!("{}\0", salt),
+            None => String::new(),
+        }
+    }
+
+    /// Include the extended attributes of the files in their digest,
+    /// so that changing an attribute is detected as a change.
+    /// This is only supported on Unix platforms and ignored elsewhere.
+    pub fn xattrs(mut self, xattrs: bool) -> ComputeOptions {
+        self.xattrs = xattrs;
+        self
+    }
+
+    /// Skip the empty files or index them with a sentinel checksum (see `EmptyFiles`),
+    /// f.e for the sync targets handling the empty files specially.
+    pub fn empty_files(mut self, empty_files: EmptyFiles) -> ComputeOptions {
+        self.empty_files = Some(empty_files);
+        self
+    }
+
+    /// Normalize the index keys using given Unicode normalization form,
+    /// so that the same file name produces the same key across platforms.
+    pub fn normalization(mut self, normalization: Normalization) -> ComputeOptions {
+        self.normalization = Some(normalization);
+        self
+    }
+
+    /// Detect the hard links (files sharing the same device & inode)
+    /// so that their content is only hashed once. Only the first path is indexed,
+    /// the others are recorded as links to it.
+    /// This is only supported on Unix platforms and ignored elsewhere.
+    pub fn hard_links(mut self, hard_links: bool) -> ComputeOptions {
+        self.hard_links = hard_links;
+        self
+    }
+
+    /// Like `ComputeOptions::hard_links`, the content of the hard linked files
+    /// is only hashed once, but all their paths are indexed with the same checksum.
+    /// This is ignored when the links are detected or the path is part of the digest.
+    /// This is only supported on Unix platforms and ignored elsewhere.
+    pub fn inode_cache(mut self, inode_cache: bool) -> ComputeOptions {
+        self.inode_cache = inode_cache;
+        self
+    }
+
+    /// Decompress the files having given extension before hashing them,
+    /// so that compressed and uncompressed copies of a file hash identically.
+    pub fn decompressor<F>(mut self, extension: &str, decompressor: F) -> ComputeOptions
+    where
+        F: Fn(Box<dyn Read>) -> Box<dyn Read> + Send + Sync + 'static,
+    {
+        self.decompressors
+            .insert(extension.to_string(), Box::new(decompressor));
+        self
+    }
+
+    /// Transparently decompress `.gz` files before hashing them.
+    pub fn gzip(self) -> ComputeOptions {
+        self.decompressor("gz", |reader| Box::new(GzDecoder::new(reader)))
+    }
+
+    /// Send given diagnostic to the logger, if any.
+    fn warn(&self, message: &str) {
+        if let Some(logger) = &self.logger {
+            logger(message);
+        }
+    }
+
+    /// Count the number of files read into given counter, f.e to check
+    /// that the unchanged files are not read again.
+    #[cfg(test)]
+    fn count_reads(mut self, reads: &Arc<std::sync::atomic::AtomicUsize>) -> ComputeOptions {
+        self.reads = Some(reads.clone());
+        self
+    }
+
+    /// Returns the reader to use to hash the file at given path.
+    fn open(&self, path: &Path) -> io::Result<Box<dyn Read>> {
+        #[cfg(test)]
+        if let Some(reads) = &self.reads {
+            reads.fetch_add(1, Ordering::SeqCst);
+        }
+
+        let file: Box<dyn Read> = match self.rate_limit {
+            Some(rate) => Box::new(ThrottledReader::new(File::open(path)?, rate)),
+            None => Box::new(File::open(path)?),
+        };
+
+        let extension = path.extension().and_then(|e| e.to_str()).unwrap_or("");
+        match self.decompressors.get(extension) {
+            Some(decompressor) => Ok(decompressor(file)),
+            None => Ok(file),
+        }
+    }
+}
+
+/// A reader which does not read more than given number of bytes per second.
+struct ThrottledReader<R> {
+    inner: R,
+    rate: u64,
+    start: Instant,
+    read: u64,
+}
+
+impl<R: Read> ThrottledReader<R> {
+    fn new(inner: R, rate: u64) -> ThrottledReader<R> {
+        ThrottledReader {
+            inner,
+            rate: rate.max(1),
+            start: Instant::now(),
+            read: 0,
+        }
+    }
+}
+
+impl<R: Read> Read for ThrottledReader<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        // never read more than a second worth of bytes at once
+        let len = buf.len().min(self.rate as usize);
+        let n = self.inner.read(&mut buf[..len])?;
+        self.read += n as u64;
+
+        // wait until the bytes read so far fit in the rate
+        let expected = Duration::from_secs_f64(self.read as f64 / self.rate as f64);
+        if let Some(delay) = expected.checked_sub(self.start.elapsed()) {
+            thread::sleep(delay);
+        }
+
+        Ok(n)
+    }
+}
+
+// the prefix of the lines recording a hard link in the index file
+const LINK_PREFIX: &str = "#link:";
+const LISTING_PREFIX: &str = "#listing:";
+const CHUNKS_PREFIX: &str = "#chunks:";
+const FIRST_SEEN_PREFIX: &str = "#seen:";
+const LABEL_PREFIX: &str = "#label:";
+const DIRECTORY_PREFIX: &str = "#directory:";
+
+// the first lines of the index file, summarizing its content
+const ENTRIES_HEADER: &str = "#entries:";
+const BYTES_HEADER: &str = "#bytes:";
+const ENCODING_HEADER: &str = "#encoding:";
+const ALGORITHM_HEADER: &str = "#algorithm:";
+const COMPUTED_HEADER: &str = "#computed:";
+const FORMAT_HEADER: &str = "#format:";
+const COLUMNS_HEADER: &str = "#columns:";
+const SALTED_HEADER: &str = "#salted";
+
+// the entries only store the part of their path which differs from the previous entry
+const COMPACT_FORMAT: &str = "compact";
+
+/// The position of the fields of the entries of an index file.
+/// The index files may name their columns (f.e `#columns:checksum,path,size,modified`),
+/// otherwise they are in the default order. The unknown columns are ignored.
+struct Columns {
+    path: usize,
+    checksum: usize,
+    size: Option<usize>,
+    modified: Option<usize>,
+}
+
+impl Default for Columns {
+    fn default() -> Columns {
+        Columns {
+            path: 0,
+            checksum: 1,
+            size: Some(2),
+            modified: Some(3),
+        }
+    }
+}
+
+impl Columns {
+    fn parse(header: &str) -> Result<Columns, Box<dyn Error>> {
+        let names: Vec<&str> = header.split(',').collect();
+        let position = |name: &str| names.iter().position(|n| *n == name);
+
+        Ok(Columns {
+            path: position("path").ok_or("missing path column")?,
+            checksum: position("checksum").ok_or("missing checksum column")?,
+            size: position("size"),
+            modified: position("modified"),
+        })
+    }
+}
+
+// the characters encoded in the paths when percent encoding is enabled
+const PERCENT_ENCODING: &str = "percent";
+const PATH_ENCODE_SET: &AsciiSet = &CONTROLS.add(b':').add(b'%');
+
+/// The metadata recorded alongside the checksum of an indexed file.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct FileMetadata {
+    /// The size of the file in bytes.
+    pub size: u64,
+    /// The last modification time of the file, if known.
+    pub modified: Option<SystemTime>,
+}
+
+impl From<&fs::Metadata> for FileMetadata {
+    fn from(metadata: &fs::Metadata) -> FileMetadata {
+        FileMetadata {
+            size: metadata.len(),
+            modified: metadata.modified().ok(),
+        }
+    }
+}
+
+/// A file hashed while computing an index.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Entry {
+    pub path: String,
+    pub checksum: String,
+}
+
+/// Options used to customize how an index is saved.
+#[derive(Default)]
+pub struct SaveOptions {
+    percent_encode: bool,
+    omit_timestamps: bool,
+    // write the largest files first instead of sorting the entries by path
+    sort_by_size: bool,
+    // factor the common prefixes of the paths
+    compact: bool,
+    // abort the save when set
+    cancel: Option<Arc<AtomicBool>>,
+    // abort the save if it takes longer
+    timeout: Option<Duration>,
+}
+
+impl SaveOptions {
+    /// Create the default options, which behave like `Index::save`.
+    pub fn new() -> SaveOptions {
+        SaveOptions::default()
+    }
+
+    /// Percent-encode the colons, the newlines (and other control characters)
+    /// in the paths so that any file name can be saved. `Index::load` decodes them back.
+    pub fn percent_encode(mut self, percent_encode: bool) -> SaveOptions {
+        self.percent_encode = percent_encode;
+        self
+    }
+
+    /// Do not save the modification times of the files, so that indexes of
+    /// the same content are identical regardless of when the files were written.
+    pub fn omit_timestamps(mut self, omit_timestamps: bool) -> SaveOptions {
+        self.omit_timestamps = omit_timestamps;
+        self
+    }
+
+    /// Write the entries by descending size (then by path) instead of by path,
+    /// so that the biggest files are found quickly when inspecting the index.
+    /// The entries whose size is unknown are written last.
+    pub fn sort_by_size(mut self, sort_by_size: bool) -> SaveOptions {
+        self.sort_by_size = sort_by_size;
+        self
+    }
+
+    /// Only write the part of each path which differs from the previous entry,
+    /// prefixed by the length shared with it, to shrink the index of deep trees.
+    /// `Index::load` reconstructs the full paths.
+    pub fn compact(mut self, compact: bool) -> SaveOptions {
+        self.compact = compact;
+        self
+    }
+
+    /// Abort the save as soon as given flag is set, f.e from another thread.
+    /// The previous index is then left intact.
+    pub fn cancel(mut self, cancel: Arc<AtomicBool>) -> SaveOptions {
+        self.cancel = Some(cancel);
+        self
+    }
+
+    /// Abort the save if it takes longer than given duration.
+    /// The previous index is then left intact.
+    pub fn timeout(mut self, timeout: Duration) -> SaveOptions {
+        self.timeout = Some(timeout);
+        self
+    }
+
+    /// Returns an error if the save started at given instant should be aborted.
+    fn check_cancelled(&self, start: Instant) -> Result<(), Box<dyn Error>> {
+        if let Some(cancel) = &self.cancel {
+            if cancel.load(Ordering::SeqCst) {
+                return Err("save cancelled".into());
+            }
+        }
+        if let Some(timeout) = self.timeout {
+            if start.elapsed() >= timeout {
+                return Err("save timed out".into());
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns the path as it should be written in the index file.
+    fn encode<'a>(&self, path: &'a str) -> Cow<'a, str> {
+        if self.percent_encode {
+            utf8_percent_encode(path, PATH_ENCODE_SET).into()
+        } else {
+            Cow::Borrowed(path)
+        }
+    }
+}
+
+#[derive(Clone)]
 pub struct Index {
     directory: PathBuf,
     files: HashMap<String, String>,
+    // the metadata of the indexed files (if known)
+    metadata: HashMap<String, FileMetadata>,
+    // the hard links to an indexed file (path -> indexed path)
+    links: HashMap<String, String>,
+    // the keys shared by many files while computing the index
+    // (f.e because of the path mapper or the Unicode normalization)
+    conflicts: Vec<String>,
+    // the symbolic links whose target does not exist, skipped while computing the index
+    broken_links: Vec<String>,
+    // prevent the index from being saved
+    read_only: bool,
+    // the label of the algorithm used to compute the checksums
+    algorithm: String,
+    // directory -> hash of the names of its children
+    listings: HashMap<String, String>,
+    // when the index has been computed (if known)
+    computed_at: Option<SystemTime>,
+    // path -> checksums of the content-defined chunks of the file
+    chunks: HashMap<String, Vec<String>>,
+    // path -> when the path has been indexed for the first time
+    first_seen: HashMap<String, SystemTime>,
+    // path -> label attached to the entry by the user
+    labels: HashMap<String, String>,
+    // the checksums have been computed using a secret salt
+    salted: bool,
+    // the (sorted) directories without any child
+    empty_directories: Vec<String>,
 }
 
 impl Index {
@@ -21,215 +874,4471 @@ impl Index {
         Index {
             directory: directory.as_ref().to_path_buf(),
             files: HashMap::new(),
+            metadata: HashMap::new(),
+            links: HashMap::new(),
+            conflicts: Vec::new(),
+            broken_links: Vec::new(),
+            read_only: false,
+            algorithm: DEFAULT_ALGORITHM.to_string(),
+            listings: HashMap::new(),
+            computed_at: None,
+            chunks: HashMap::new(),
+            first_seen: HashMap::new(),
+            labels: HashMap::new(),
+            salted: false,
+            empty_directories: Vec::new(),
         }
     }
 
     /// Try to load the cached index for given directory
     /// this will either return the loaded index or a new blank one.
     pub fn load<P: AsRef<Path>>(directory: P) -> Result<Index, Box<dyn Error>> {
-        let index_path = directory.as_ref().join(INDEX_FILE);
+        Index::load_from_backend(&FsBackend, directory)
+    }
+
+    /// Load the index for given directory from given backend
+    /// this will either return the loaded index or a new blank one.
+    pub fn load_from_backend<P: AsRef<Path>>(
+        backend: &dyn Backend,
+        directory: P,
+    ) -> Result<Index, Box<dyn Error>> {
+        // if there's no index for the directory, return
+        // new blank index
+        match backend.read_index(directory.as_ref())? {
+            Some(reader) => Index::load_reader(reader, directory),
+            None => Ok(Index::blank(directory)),
+        }
+    }
+
+    /// Load an index for given directory from given reader (holding the content
+    /// of an index file), f.e a reference index bundled in memory.
+    pub fn load_reader<R: Read, P: AsRef<Path>>(
+        mut reader: R,
+        directory: P,
+    ) -> Result<Index, Box<dyn Error>> {
+        // make sure the index is not corrupted
+        let mut content = String::new();
+        reader.read_to_string(&mut content)?;
+        let content = verify_checksum(content.trim_start_matches(BOM))?;
+
+        // and read it line by line
+        let mut files: HashMap<String, String> = HashMap::new();
+        let mut metadata: HashMap<String, FileMetadata> = HashMap::new();
+        let mut links: HashMap<String, String> = HashMap::new();
+        let mut listings: HashMap<String, String> = HashMap::new();
+        let mut chunks: HashMap<String, Vec<String>> = HashMap::new();
+        let mut first_seen: HashMap<String, SystemTime> = HashMap::new();
+        let mut labels: HashMap<String, String> = HashMap::new();
+        let mut empty_directories: Vec<String> = Vec::new();
+        let mut percent_encoded = false;
+        let mut compact = false;
+        let mut salted = false;
+        let mut previous_key = String::new();
+        let mut columns = Columns::default();
+        let mut algorithm = DEFAULT_ALGORITHM.to_string();
+        let mut computed_at = None;
+        let decode = |path: &str, percent_encoded: bool| -> Result<String, Box<dyn Error>> {
+            if percent_encoded {
+                Ok(percent_decode_str(path).decode_utf8()?.to_string())
+            } else {
+                Ok(path.to_string())
+            }
+        };
+
+        for line in read_lines(content.as_bytes())? {
+            // the summary can be computed back from the entries
+            if line.starts_with(ENTRIES_HEADER) || line.starts_with(BYTES_HEADER) {
+                continue;
+            }
+
+            if let Some(label) = line.strip_prefix(ALGORITHM_HEADER) {
+                algorithm = label.to_string();
+                continue;
+            }
+
+            if let Some(nanos) = line.strip_prefix(COMPUTED_HEADER) {
+                computed_at = Some(UNIX_EPOCH + Duration::from_nanos(nanos.parse()?));
+                continue;
+            }
+
+            if let Some(encoding) = line.strip_prefix(ENCODING_HEADER) {
+                if encoding != PERCENT_ENCODING {
+                    return Err(format!("unsupported index encoding: {}", encoding).into());
+                }
+                percent_encoded = true;
+                continue;
+            }
+
+            if line == SALTED_HEADER {
+                salted = true;
+                continue;
+            }
+
+            if let Some(header) = line.strip_prefix(COLUMNS_HEADER) {
+                columns = Columns::parse(header)?;
+                continue;
+            }
+
+            if let Some(format) = line.strip_prefix(FORMAT_HEADER) {
+                if format != COMPACT_FORMAT {
+                    return Err(format!("unsupported index format: {}", format).into());
+                }
+                compact = true;
+                continue;
+            }
+
+            if let Some(link) = line.strip_prefix(LINK_PREFIX) {
+                let (path, target) = link
+                    .split_once(':')
+                    .ok_or("corrupted index file: invalid link")?;
+                links.insert(
+                    decode(path, percent_encoded)?,
+                    decode(target, percent_encoded)?,
+                );
+                continue;
+            }
+
+            if let Some(listing) = line.strip_prefix(LISTING_PREFIX) {
+                let (directory, hash) = listing
+                    .split_once(':')
+                    .ok_or("corrupted index file: invalid listing")?;
+                listings.insert(decode(directory, percent_encoded)?, hash.to_string());
+                continue;
+            }
+
+            if let Some(line) = line.strip_prefix(CHUNKS_PREFIX) {
+                let (path, file_chunks) = line
+                    .split_once(':')
+                    .ok_or("corrupted index file: invalid chunks")?;
+                chunks.insert(
+                    decode(path, percent_encoded)?,
+                    file_chunks
+                        .split(',')
+                        .filter(|c| !c.is_empty())
+                        .map(|c| c.to_string())
+                        .collect(),
+                );
+                continue;
+            }
+
+            if let Some(line) = line.strip_prefix(FIRST_SEEN_PREFIX) {
+                let (path, nanos) = line
+                    .split_once(':')
+                    .ok_or("corrupted index file: invalid first seen time")?;
+                first_seen.insert(
+                    decode(path, percent_encoded)?,
+                    UNIX_EPOCH + Duration::from_nanos(nanos.parse()?),
+                );
+                continue;
+            }
+
+            if let Some(directory) = line.strip_prefix(DIRECTORY_PREFIX) {
+                empty_directories.push(decode(directory, percent_encoded)?);
+                continue;
+            }
+
+            if let Some(line) = line.strip_prefix(LABEL_PREFIX) {
+                let (path, label) = line
+                    .split_once(':')
+                    .ok_or("corrupted index file: invalid label")?;
+                labels.insert(
+                    decode(path, percent_encoded)?,
+                    decode(label, percent_encoded)?,
+                );
+                continue;
+            }
+
+            // reconstruct the path from the one of the previous entry
+            let line = if compact {
+                let (shared, rest) = line.split_once(';').ok_or("invalid compact entry")?;
+                let prefix = previous_key
+                    .get(..shared.parse()?)
+                    .ok_or("invalid compact entry")?;
+                let line = format!("{}{}", prefix, rest);
+                previous_key = line.split(':').next().unwrap_or_default().to_string();
+                line
+            } else {
+                line
+            };
+
+            // the size & modification time (in nanoseconds since the Unix epoch)
+            // are missing from indexes written by older versions (or empty)
+            let parts: Vec<&str> = line.split(':').collect();
+            let field = |column: Option<usize>| column.and_then(|i| parts.get(i).copied());
+            let optional_field = |column: Option<usize>| field(column).filter(|f| !f.is_empty());
+            let path = field(Some(columns.path)).ok_or("invalid index entry")?;
+            let path = decode(unescape_key(path), percent_encoded)?;
+            let checksum = field(Some(columns.checksum)).ok_or("invalid index entry")?;
+            if let Some(size) = optional_field(columns.size) {
+                let size = size.parse()?;
+                let modified = match optional_field(columns.modified) {
+                    Some(nanos) => Some(UNIX_EPOCH + Duration::from_nanos(nanos.parse()?)),
+                    None => None,
+                };
+                metadata.insert(path.to_string(), FileMetadata { size, modified });
+            }
+            files.insert(path, checksum.to_string());
+        }
+
+        Ok(Index {
+            files,
+            metadata,
+            links,
+            algorithm,
+            listings,
+            computed_at,
+            chunks,
+            first_seen,
+            labels,
+            salted,
+            empty_directories,
+            ..Index::blank(directory)
+        })
+    }
+
+    /// Read the number of entries and the total size of the files
+    /// from the header of the cached index of given directory, without loading it.
+    /// return `None` if there's no index or if it has no header.
+    pub fn read_summary<P: AsRef<Path>>(
+        directory: P,
+    ) -> Result<Option<(usize, u64)>, Box<dyn Error>> {
+        let file = match File::open(directory.as_ref().join(INDEX_FILE)) {
+            Ok(file) => file,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(None),
+            Err(e) => return Err(e.into()),
+        };
+
+        let mut entries = None;
+        let mut bytes = None;
+        for line in BufReader::new(file).lines() {
+            let line = line?;
+            let line = line.trim_start_matches(BOM);
+            if let Some(value) = line.strip_prefix(ENTRIES_HEADER) {
+                entries = Some(value.parse()?);
+            } else if let Some(value) = line.strip_prefix(BYTES_HEADER) {
+                bytes = Some(value.parse()?);
+            } else if !line.starts_with('#') {
+                break;
+            }
+        }
+
+        Ok(entries.zip(bytes))
+    }
+
+    /// Load the cached index of each given directory.
+    /// All the directories are processed, and the errors are aggregated.
+    pub fn load_all<P: AsRef<Path>>(
+        directories: &[P],
+    ) -> Result<HashMap<PathBuf, Index>, Box<dyn Error>> {
+        let mut indexes: HashMap<PathBuf, Index> = HashMap::new();
+        let mut errors: Vec<String> = Vec::new();
+
+        for directory in directories {
+            match Index::load(directory) {
+                Ok(index) => {
+                    indexes.insert(directory.as_ref().to_path_buf(), index);
+                }
+                Err(e) => errors.push(format!("{}: {}", directory.as_ref().display(), e)),
+            }
+        }
+
+        if !errors.is_empty() {
+            return Err(format!("unable to load indexes: {}", errors.join(", ")).into());
+        }
+
+        Ok(indexes)
+    }
+
+    /// Compute the index for given directory.
+    /// The computation is deterministic: computing & saving the index of
+    /// an unchanged directory always produces the same index file.
+    pub fn compute<P: AsRef<Path>>(directory: P) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_with_options(directory, &ComputeOptions::default())
+    }
+
+    /// Compute the index for given directory, rewriting each relative path
+    /// using given mapper. Files mapped to an empty string are skipped.
+    pub fn compute_with_path_mapper<P, F>(
+        directory: P,
+        mapper: F,
+    ) -> Result<(Index, usize), Box<dyn Error>>
+    where
+        P: AsRef<Path>,
+        F: Fn(&str) -> String + Send + Sync + 'static,
+    {
+        Index::compute_with_options(directory, &ComputeOptions::new().path_mapper(mapper))
+    }
+
+    /// Compute the index for given directory, including the relative
+    /// path of the files in their digest.
+    pub fn compute_with_path_in_digest<P: AsRef<Path>>(
+        directory: P,
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_with_options(directory, &ComputeOptions::new().path_in_digest(true))
+    }
+
+    /// Compute the index for given directory, skipping the files whose
+    /// relative path matches one of given regular expressions.
+    pub fn compute_with_regex_excludes<P: AsRef<Path>>(
+        directory: P,
+        patterns: &[Regex],
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_with_options(directory, &ComputeOptions::new().regex_excludes(patterns))
+    }
+
+    /// Compute the index for given directory, storing the checksums of the
+    /// content-defined chunks of each file (see `ComputeOptions::chunking`).
+    pub fn compute_cdc<P: AsRef<Path>>(
+        directory: P,
+        avg_chunk: usize,
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_with_options(directory, &ComputeOptions::new().chunking(avg_chunk))
+    }
+
+    /// Compute the index for given directory, only indexing the files
+    /// whose content starts with one of given magic bytes.
+    pub fn compute_with_magic<P: AsRef<Path>>(
+        directory: P,
+        magics: &[&[u8]],
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_with_options(directory, &ComputeOptions::new().magics(magics))
+    }
+
+    /// Compute the index for given directory, skipping the given number
+    /// of most recently modified files.
+    pub fn compute_exclude_newest<P: AsRef<Path>>(
+        directory: P,
+        n: usize,
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_with_options(directory, &ComputeOptions::new().exclude_newest(n))
+    }
+
+    /// Compute the index for given directory, skipping the files having
+    /// one of given inode numbers.
+    #[cfg(unix)]
+    pub fn compute_exclude_inodes<P: AsRef<Path>>(
+        directory: P,
+        inodes: &HashSet<u64>,
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_with_options(directory, &ComputeOptions::new().exclude_inodes(inodes))
+    }
+
+    /// Compute the index for given directory using the hash function created
+    /// by given factory. The label identifies the algorithm in the saved index.
+    pub fn compute_with_hasher<P, F>(
+        directory: P,
+        label: &str,
+        factory: F,
+    ) -> Result<(Index, usize), Box<dyn Error>>
+    where
+        P: AsRef<Path>,
+        F: Fn() -> Box<dyn Hasher> + Send + Sync + 'static,
+    {
+        Index::compute_with_options(directory, &ComputeOptions::new().hasher(label, factory))
+    }
+
+    /// Compute the index for given directory using given options.
+    pub fn compute_with_options<P: AsRef<Path>>(
+        directory: P,
+        options: &ComputeOptions,
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_reusing(directory.as_ref(), options, None)
+    }
+
+    /// Compute the index for given directory, only hashing the files whose size or
+    /// modification time differ from the previous index: the checksums of the other files
+    /// are copied from it. The result is a full index, without the deleted files.
+    pub fn compute_incremental<P: AsRef<Path>>(
+        directory: P,
+        previous: &Index,
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_incremental_with_options(directory, previous, &ComputeOptions::default())
+    }
+
+    /// Like `Index::compute_incremental`, using given options.
+    /// The previous index should have been computed using the same options.
+    pub fn compute_incremental_with_options<P: AsRef<Path>>(
+        directory: P,
+        previous: &Index,
+        options: &ComputeOptions,
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        Index::compute_reusing(directory.as_ref(), options, Some(previous))
+    }
+
+    /// Compute the index for given directory using given options,
+    /// reusing the checksums of the unchanged files of the previous index (if any).
+    fn compute_reusing(
+        directory: &Path,
+        options: &ComputeOptions,
+        previous: Option<&Index>,
+    ) -> Result<(Index, usize), Box<dyn Error>> {
+        // the checksums are only comparable if computed using the same algorithm
+        // (the salt being unknown, the salted checksums are never reused)
+        let previous = previous.filter(|previous| {
+            previous.algorithm == options.algorithm() && !previous.salted && options.salt.is_none()
+        });
+        let mut files: HashMap<String, String> = HashMap::new();
+        let mut files_metadata: HashMap<String, FileMetadata> = HashMap::new();
+        let mut links: HashMap<String, String> = HashMap::new();
+        let mut inodes: HashMap<(u64, u64), String> = HashMap::new();
+        let mut conflicts: Vec<String> = Vec::new();
+        let mut chunks: HashMap<String, Vec<String>> = HashMap::new();
+        let mut first_seen: HashMap<String, SystemTime> = HashMap::new();
+        let now = SystemTime::now();
+        let directory = options.root(directory)?;
+
+        // find the most recently modified files (the files whose modification time
+        // is unknown being the oldest), the ties being broken by path
+        let mut newest: HashSet<String> = HashSet::new();
+        if options.exclude_newest > 0 {
+            let mut modified: Vec<(Option<SystemTime>, String)> = Vec::new();
+            walk(&directory, options, false, |_, metadata, key| {
+                modified.push((metadata.modified().ok(), key));
+                Ok(())
+            })?;
+            modified.sort_by(|a, b| b.0.cmp(&a.0).then_with(|| a.1.cmp(&b.1)));
+            newest.extend(
+                modified
+                    .into_iter()
+                    .take(options.exclude_newest)
+                    .map(|(_, key)| key),
+            );
+        }
+
+        let walked = walk(&directory, options, true, |entry, metadata, key| {
+            if newest.contains(&key) {
+                return Ok(());
+            }
+
+            // many files collapsing to the same key would silently overwrite each other
+            if files.contains_key(&key) && !conflicts.contains(&key) {
+                options.warn(&format!("many files share the key: {}", key));
+                conflicts.push(key.to_string());
+            }
+
+            // only hash the first path of a hard linked file
+            if options.hard_links {
+                if let Some(inode) = hard_link_inode(metadata) {
+                    if let Some(path) = inodes.get(&inode) {
+                        links.insert(key, path.to_string());
+                        return Ok(());
+                    }
+                    inodes.insert(inode, key.to_string());
+                }
+            }
+
+            if options.first_seen {
+                let time = previous
+                    .and_then(|previous| previous.first_seen.get(&key))
+                    .copied()
+                    .unwrap_or(now);
+                first_seen.insert(key.to_string(), time);
+            }
+
+            // the other paths of a hard linked file share its checksum
+            let inode = if options.inode_cache && !options.hard_links && !options.path_in_digest {
+                hard_link_inode(metadata)
+            } else {
+                None
+            };
+            if let Some(path) = inode.and_then(|inode| inodes.get(&inode)) {
+                if let Some(file_chunks) = chunks.get(path).cloned() {
+                    chunks.insert(key.to_string(), file_chunks);
+                }
+                let hash = files[path].to_string();
+                files_metadata.insert(key.to_string(), FileMetadata::from(metadata));
+                files.insert(key, hash);
+                return Ok(());
+            }
+
+            // a file whose size & modification time did not change is not hashed again
+            let current = FileMetadata::from(metadata);
+            let previous = previous.filter(|previous| match previous.metadata.get(&key) {
+                Some(m) => m.modified.is_some() && *m == current,
+                None => false,
+            });
+
+            let hash = match previous.and_then(|previous| previous.files.get(&key)) {
+                Some(hash) => hash.to_string(),
+                None => hash_entry(options, entry.path(), &key, metadata)?,
+            };
+            if let Some(avg_chunk) = options.avg_chunk {
+                let file_chunks = match previous.and_then(|previous| previous.chunks.get(&key)) {
+                    Some(file_chunks) => file_chunks.clone(),
+                    None => chunk_reader(
+                        options.open(entry.path())?,
+                        avg_chunk,
+                        options.salt_prefix().as_bytes(),
+                    )?,
+                };
+                chunks.insert(key.to_string(), file_chunks);
+            }
+            files_metadata.insert(key.to_string(), current);
+            if let Some(inode) = inode {
+                inodes.insert(inode, key.to_string());
+            }
+            files.insert(key, hash);
+            Ok(())
+        })?;
+
+        let listings = if options.directory_listings {
+            directory_listings(files.keys().chain(links.keys()))?
+        } else {
+            HashMap::new()
+        };
+
+        Ok((
+            Index {
+                files,
+                metadata: files_metadata,
+                links,
+                conflicts,
+                broken_links: walked.broken_links,
+                empty_directories: walked.empty_directories,
+                algorithm: options.algorithm().to_string(),
+                computed_at: if options.record_time {
+                    Some(SystemTime::now())
+                } else {
+                    None
+                },
+                listings,
+                chunks,
+                first_seen,
+                salted: options.salt.is_some(),
+                ..Index::blank(directory)
+            },
+            walked.ignored,
+        ))
+    }
+
+    /// Compute the index for given directory in a background thread,
+    /// sending each entry as soon as it is hashed so that the caller can start
+    /// processing the files before the whole index is computed.
+    /// The channel is closed once the directory has been walked, an error being
+    /// sent (as last message) if the computation fails.
+    pub fn compute_stream<P: AsRef<Path>>(
+        directory: P,
+    ) -> Receiver<Result<Entry, Box<dyn Error + Send + Sync>>> {
+        let directory = directory.as_ref().to_path_buf();
+        let (tx, rx) = mpsc::channel();
+
+        thread::spawn(move || {
+            let options = ComputeOptions::default();
+            let result = walk(&directory, &options, true, |entry, _, key| {
+                let checksum = hash_file(&options, entry.path(), &key)?;
+                tx.send(Ok(Entry {
+                    path: key,
+                    checksum,
+                }))
+                .map_err(|e| e.to_string().into())
+            });
+
+            if let Err(e) = result {
+                let _ = tx.send(Err(e.to_string().into()));
+            }
+        });
+
+        rx
+    }
+
+    /// Compute a partial index of given directory holding only the files at given
+    /// (relative) paths, f.e the files reported as changed by a file watcher.
+    /// The paths which no longer exist are not part of the result.
+    pub fn compute_paths<P: AsRef<Path>>(
+        directory: P,
+        paths: &[&str],
+    ) -> Result<Index, Box<dyn Error>> {
+        Index::compute_paths_with_options(directory, paths, &ComputeOptions::default())
+    }
+
+    /// Like `Index::compute_paths`, using given options. The paths are filtered
+    /// like any walked file, so the ignored ones are not part of the result either.
+    pub fn compute_paths_with_options<P: AsRef<Path>>(
+        directory: P,
+        paths: &[&str],
+        options: &ComputeOptions,
+    ) -> Result<Index, Box<dyn Error>> {
+        let directory = options.root(directory.as_ref())?;
+        let paths: HashSet<&str> = paths.iter().copied().collect();
+        let mut files: HashMap<String, String> = HashMap::new();
+        let mut metadata: HashMap<String, FileMetadata> = HashMap::new();
+
+        walk(&directory, options, false, |entry, file_metadata, key| {
+            let local_path = entry.path().strip_prefix(&directory)?;
+            if !paths.contains(to_slash(local_path).as_ref()) {
+                return Ok(());
+            }
+
+            let hash = hash_entry(options, entry.path(), &key, file_metadata)?;
+            metadata.insert(key.to_string(), FileMetadata::from(file_metadata));
+            files.insert(key, hash);
+            Ok(())
+        })?;
+
+        Ok(Index {
+            files,
+            metadata,
+            algorithm: options.algorithm().to_string(),
+            salted: options.salt.is_some(),
+            ..Index::blank(directory)
+        })
+    }
+
+    /// Like `Index::compute_paths`, but read the (relative) paths from given reader,
+    /// one per line, so that an external tool (f.e `find`) can select the files.
+    /// The blank lines are skipped and the leading `./` of the paths is removed.
+    pub fn compute_file_list<R: Read, P: AsRef<Path>>(
+        reader: R,
+        directory: P,
+    ) -> Result<Index, Box<dyn Error>> {
+        let mut paths = Vec::new();
+        for line in BufReader::new(reader).lines() {
+            let line = line?;
+            let path = line.trim_end_matches('\r');
+            let path = path.strip_prefix("./").unwrap_or(path);
+            if !path.is_empty() {
+                paths.push(path.to_string());
+            }
+        }
+
+        let paths: Vec<&str> = paths.iter().map(|path| path.as_str()).collect();
+        Index::compute_paths(directory, &paths)
+    }
+
+    /// Compute the index of the files yielded by given source as (path, content) pairs,
+    /// f.e the files of a zip archive or of an in-memory tree, keyed by their path.
+    /// No metadata is recorded since only the content of the files is known.
+    pub fn compute_from<I, R, P>(entries: I, directory: P) -> Result<Index, Box<dyn Error>>
+    where
+        I: IntoIterator<Item = io::Result<(String, R)>>,
+        R: Read,
+        P: AsRef<Path>,
+    {
+        let mut files: HashMap<String, String> = HashMap::new();
+        for entry in entries {
+            let (path, reader) = entry?;
+            files.insert(path, hash_reader(reader)?);
+        }
+
+        Ok(Index {
+            files,
+            ..Index::blank(directory)
+        })
+    }
+
+    /// Compute the index of the regular files of given tar archive,
+    /// keyed by their path in the archive, so that it can be diffed against
+    /// the index of given directory.
+    pub fn compute_tar<R: Read, P: AsRef<Path>>(
+        reader: R,
+        directory: P,
+    ) -> Result<Index, Box<dyn Error>> {
+        let mut files: HashMap<String, String> = HashMap::new();
+        let mut metadata: HashMap<String, FileMetadata> = HashMap::new();
+
+        let mut archive = tar::Archive::new(reader);
+        for entry in archive.entries()? {
+            let entry = entry?;
+            if !entry.header().entry_type().is_file() {
+                continue;
+            }
+
+            let path = entry.path()?;
+            let path = path.strip_prefix(".").unwrap_or(&path);
+            let key = match path.to_str() {
+                Some(key) => key.to_string(),
+                None => return Err(format!("invalid path in archive: {:?}", path).into()),
+            };
+            let modified = entry
+                .header()
+                .mtime()
+                .ok()
+                .map(|secs| UNIX_EPOCH + Duration::from_secs(secs));
+
+            metadata.insert(
+                key.to_string(),
+                FileMetadata {
+                    size: entry.size(),
+                    modified,
+                },
+            );
+            files.insert(key, hash_reader(entry)?);
+        }
+
+        Ok(Index {
+            files,
+            metadata,
+            ..Index::blank(directory)
+        })
+    }
+
+    /// Estimate the work needed to compute the index for given directory
+    /// by walking it without hashing anything.
+    /// return the number of files that would be indexed and their size in bytes.
+    pub fn estimate_compute<P: AsRef<Path>>(directory: P) -> Result<(usize, u64), Box<dyn Error>> {
+        Index::estimate_compute_with_options(directory, &ComputeOptions::default())
+    }
+
+    /// Estimate the work needed to compute the index for given directory using given options.
+    pub fn estimate_compute_with_options<P: AsRef<Path>>(
+        directory: P,
+        options: &ComputeOptions,
+    ) -> Result<(usize, u64), Box<dyn Error>> {
+        let mut files = 0;
+        let mut bytes = 0;
+        walk(
+            &options.root(directory.as_ref())?,
+            options,
+            true,
+            |_, metadata, _| {
+                files += 1;
+                bytes += metadata.len();
+                Ok(())
+            },
+        )?;
+
+        Ok((files, bytes))
+    }
+
+    /// Save the index to the disk.
+    /// The file starts with a summary of the index (see `Index::read_summary`),
+    /// then the entries are sorted and streamed to the file, followed by a checksum
+    /// of the content so that `Index::load` can detect corruption.
+    /// The bytes are written as is: the lines always end with `\n`, whatever the platform,
+    /// so that the same index is saved the same way everywhere.
+    pub fn save(&self) -> Result<(), Box<dyn Error>> {
+        self.save_with_options(&SaveOptions::default())
+    }
+
+    /// Save the index to the disk using given options.
+    pub fn save_with_options(&self, options: &SaveOptions) -> Result<(), Box<dyn Error>> {
+        self.save_to_backend(&FsBackend, options)
+    }
+
+    /// Save the index to given backend using given options.
+    pub fn save_to_backend(
+        &self,
+        backend: &dyn Backend,
+        options: &SaveOptions,
+    ) -> Result<(), Box<dyn Error>> {
+        if self.read_only {
+            return Err("unable to save a read-only index".into());
+        }
+
+        let start = Instant::now();
+        let mut writer = BufWriter::new(backend.write_index(&self.directory)?);
+        let mut hasher = sha1::Sha1::new();
+
+        let mut header = format!(
+            "{}{}\n{}{}\n",
+            ENTRIES_HEADER,
+            self.len(),
+            BYTES_HEADER,
+            self.total_size()
+        );
+        if self.algorithm != DEFAULT_ALGORITHM {
+            header += format!("{}{}\n", ALGORITHM_HEADER, self.algorithm).as_str();
+        }
+        if let Some(computed_at) = self
+            .computed_at
+            .filter(|_| !options.omit_timestamps)
+            .and_then(|t| t.duration_since(UNIX_EPOCH).ok())
+        {
+            header += format!("{}{}\n", COMPUTED_HEADER, computed_at.as_nanos()).as_str();
+        }
+        if options.percent_encode {
+            header += format!("{}{}\n", ENCODING_HEADER, PERCENT_ENCODING).as_str();
+        }
+        if options.compact {
+            header += format!("{}{}\n", FORMAT_HEADER, COMPACT_FORMAT).as_str();
+        }
+        if self.salted {
+            header += format!("{}\n", SALTED_HEADER).as_str();
+        }
+        hasher.update(header.as_bytes());
+        writer.write_all(header.as_bytes())?;
+
+        let mut paths: Vec<&String> = self.files.keys().collect();
+        paths.sort();
+        if options.sort_by_size {
+            // the sort is stable so the paths of the same size stay sorted
+            paths.sort_by_key(|path| Reverse(self.metadata.get(*path).map(|m| m.size)));
+        }
+
+        let mut previous_key = String::new();
+        for path in paths {
+            options.check_cancelled(start)?;
+
+            let key = escape_key(options.encode(path));
+            let key = if options.compact {
+                let shared = shared_prefix_len(&previous_key, &key);
+                let compact_key = format!("{};{}", shared, &key[shared..]);
+                previous_key = key.to_string();
+                Cow::Owned(compact_key)
+            } else {
+                key
+            };
+            let modified = self
+                .metadata
+                .get(path)
+                .and_then(|m| m.modified)
+                .filter(|_| !options.omit_timestamps)
+                .and_then(|m| m.duration_since(UNIX_EPOCH).ok());
+            let line = match (self.metadata.get(path), modified) {
+                (Some(metadata), Some(modified)) => format!(
+                    "{}:{}:{}:{}\n",
+                    key,
+                    self.files[path],
+                    metadata.size,
+                    modified.as_nanos()
+                ),
+                (Some(metadata), None) => {
+                    format!("{}:{}:{}\n", key, self.files[path], metadata.size)
+                }
+                (None, _) => format!("{}:{}\n", key, self.files[path]),
+            };
+            hasher.update(line.as_bytes());
+            writer.write_all(line.as_bytes())?;
+        }
+
+        let mut links: Vec<&String> = self.links.keys().collect();
+        links.sort();
+
+        for path in links {
+            let line = format!(
+                "{}{}:{}\n",
+                LINK_PREFIX,
+                options.encode(path),
+                options.encode(&self.links[path])
+            );
+            hasher.update(line.as_bytes());
+            writer.write_all(line.as_bytes())?;
+        }
+
+        let mut listings: Vec<&String> = self.listings.keys().collect();
+        listings.sort();
+
+        for directory in listings {
+            let line = format!(
+                "{}{}:{}\n",
+                LISTING_PREFIX,
+                options.encode(directory),
+                self.listings[directory]
+            );
+            hasher.update(line.as_bytes());
+            writer.write_all(line.as_bytes())?;
+        }
+
+        let mut chunked: Vec<&String> = self.chunks.keys().collect();
+        chunked.sort();
+
+        for path in chunked {
+            let line = format!(
+                "{}{}:{}\n",
+                CHUNKS_PREFIX,
+                options.encode(path),
+                self.chunks[path].join(",")
+            );
+            hasher.update(line.as_bytes());
+            writer.write_all(line.as_bytes())?;
+        }
+
+        let mut seen: Vec<&String> = if options.omit_timestamps {
+            Vec::new()
+        } else {
+            self.first_seen.keys().collect()
+        };
+        seen.sort();
+
+        for path in seen {
+            if let Ok(time) = self.first_seen[path].duration_since(UNIX_EPOCH) {
+                let line = format!(
+                    "{}{}:{}\n",
+                    FIRST_SEEN_PREFIX,
+                    options.encode(path),
+                    time.as_nanos()
+                );
+                hasher.update(line.as_bytes());
+                writer.write_all(line.as_bytes())?;
+            }
+        }
+
+        let mut labelled: Vec<&String> = self.labels.keys().collect();
+        labelled.sort();
+
+        for path in labelled {
+            let line = format!(
+                "{}{}:{}\n",
+                LABEL_PREFIX,
+                options.encode(path),
+                options.encode(&self.labels[path])
+            );
+            hasher.update(line.as_bytes());
+            writer.write_all(line.as_bytes())?;
+        }
+
+        for directory in &self.empty_directories {
+            let line = format!("{}{}\n", DIRECTORY_PREFIX, options.encode(directory));
+            hasher.update(line.as_bytes());
+            writer.write_all(line.as_bytes())?;
+        }
+
+        // append the checksum footer
+        writeln!(writer, "{}{:x}", CHECKSUM_FOOTER, hasher.finalize())?;
+
+        options.check_cancelled(start)?;
+        let writer = writer.into_inner().map_err(|e| e.into_error())?;
+        writer.commit().map_err(|e| e.into())
+    }
+
+    /// Load an index for given directory from a NDJSON stream
+    /// where each line is a JSON object describing one entry.
+    pub fn load_ndjson<R: Read, P: AsRef<Path>>(
+        reader: R,
+        directory: P,
+    ) -> Result<Index, Box<dyn Error>> {
+        let mut files: HashMap<String, String> = HashMap::new();
+        for line in read_lines(reader)? {
+            if line.is_empty() {
+                continue;
+            }
+
+            let entry: NdjsonEntry = serde_json::from_str(&line)?;
+            files.insert(entry.path, entry.hash);
+        }
+
+        Ok(Index {
+            files,
+            ..Index::blank(directory)
+        })
+    }
+
+    /// Write the index as NDJSON (one JSON object per entry) to given writer,
+    /// the entries being sorted by path like in the index file.
+    pub fn save_ndjson<W: Write>(&self, mut writer: W) -> Result<(), Box<dyn Error>> {
+        let mut paths: Vec<&String> = self.files.keys().collect();
+        paths.sort();
+
+        for path in paths {
+            let entry = NdjsonEntry {
+                path: path.to_string(),
+                hash: self.files[path].to_string(),
+            };
+            serde_json::to_writer(&mut writer, &entry)?;
+            writer.write_all(b"\n")?;
+        }
+
+        writer.flush().map_err(|e| e.into())
+    }
+
+    /// Write the (sorted) entries of the index to given writer using the format
+    /// of the coreutils checksum tools, so that the files can be verified
+    /// with f.e `sha1sum -c`: the checksum, two spaces and the path.
+    /// As done by these tools, the paths containing a backslash or a newline
+    /// are escaped and their line is prefixed by a backslash.
+    pub fn export_sumfile<W: Write>(&self, mut writer: W) -> Result<(), Box<dyn Error>> {
+        let mut paths: Vec<&String> = self.files.keys().collect();
+        paths.sort();
+
+        for path in paths {
+            if path.contains('\\') || path.contains('\n') {
+                let escaped = path.replace('\\', "\\\\").replace('\n', "\\n");
+                writeln!(writer, "\\{}  {}", self.files[path], escaped)?;
+            } else {
+                writeln!(writer, "{}  {}", self.files[path], path)?;
+            }
+        }
+
+        writer.flush().map_err(|e| e.into())
+    }
+
+    /// Load an index for given directory from the output of a coreutils checksum tool
+    /// (see `Index::export_sumfile`), in text or binary (`*`) mode.
+    /// The algorithm is deduced from the length of the checksums.
+    pub fn import_sumfile<R: Read, P: AsRef<Path>>(
+        reader: R,
+        directory: P,
+    ) -> Result<Index, Box<dyn Error>> {
+        let mut files: HashMap<String, String> = HashMap::new();
+        let mut algorithm: Option<&str> = None;
+
+        for line in read_lines(reader)? {
+            if line.is_empty() {
+                continue;
+            }
+
+            let (escaped, line) = match line.strip_prefix('\\') {
+                Some(line) => (true, line),
+                None => (false, line.as_str()),
+            };
+
+            // the checksum is followed by a space and the mode (space or '*' for binary)
+            let (hash, path) = match line
+                .split_once(' ')
+                .and_then(|(hash, rest)| Some((hash, rest.strip_prefix(&[' ', '*'][..])?)))
+            {
+                Some(parts) => parts,
+                None => return Err(format!("invalid checksum line: {}", line).into()),
+            };
+
+            let label = match hash.len() {
+                32 => "md5",
+                40 => DEFAULT_ALGORITHM,
+                56 => "sha224",
+                64 => "sha256",
+                96 => "sha384",
+                128 => "sha512",
+                _ => return Err(format!("unsupported checksum: {}", hash).into()),
+            };
+            if matches!(algorithm, Some(algorithm) if algorithm != label) {
+                return Err("the checksums use different algorithms".into());
+            }
+            algorithm = Some(label);
+
+            let path = if escaped {
+                unescape_sumfile_path(path)
+            } else {
+                path.to_string()
+            };
+            files.insert(path, hash.to_lowercase());
+        }
+
+        Ok(Index {
+            files,
+            algorithm: algorithm.unwrap_or(DEFAULT_ALGORITHM).to_string(),
+            ..Index::blank(directory)
+        })
+    }
+
+    /// Compute the difference between the indexes self & b
+    /// return the changed files (new, modified) and the deleted.
+    /// Only the (relative) keys & checksums are compared, so the indexes
+    /// may have been computed from different directories.
+    pub fn diff(&self, b: &Index) -> (Vec<String>, Vec<String>) {
+        let mut changed_files: Vec<String> = Vec::new();
+        let mut deleted_files: Vec<String> = Vec::new();
+
+        for (path, hash) in &b.files {
+            if self.files.get(path).is_none() || self.files.get(path).unwrap() != hash {
+                changed_files.push(path.to_string());
+            }
+        }
+
+        for path in self.files.keys() {
+            if !b.files.contains_key(path) {
+                deleted_files.push(path.to_string());
+            }
+        }
+
+        (changed_files, deleted_files)
+    }
+
+    /// Compute the difference between the indexes self & b, like `Index::diff`,
+    /// except that an `AlgorithmMismatch` error is returned if their checksums
+    /// have been computed using different algorithms (and therefore cannot be compared).
+    pub fn checked_diff(&self, b: &Index) -> Result<(Vec<String>, Vec<String>), Box<dyn Error>> {
+        if self.hash_label() != b.hash_label() {
+            return Err(Box::new(AlgorithmMismatch {
+                a: self.hash_label(),
+                b: b.hash_label(),
+            }));
+        }
+
+        Ok(self.diff(b))
+    }
+
+    /// Compute the difference between the indexes self & b, like `Index::diff`,
+    /// except that the deletions of the expected files are not reported.
+    pub fn diff_expect(
+        &self,
+        b: &Index,
+        expected_deletions: &HashSet<String>,
+    ) -> (Vec<String>, Vec<String>) {
+        let (changed_files, mut deleted_files) = self.diff(b);
+        deleted_files.retain(|path| !expected_deletions.contains(path));
+        (changed_files, deleted_files)
+    }
+
+    /// Compute the difference between the indexes self & b, keeping only
+    /// the files whose size changed by more than given number of bytes
+    /// (an added or deleted file changing from or to an empty file).
+    /// The files whose size is unknown are not reported.
+    /// return the (sorted) changed files.
+    pub fn diff_by_size_change(&self, b: &Index, min_delta: u64) -> Vec<String> {
+        let size = |index: &Index, path: &str| -> Option<u64> {
+            if !index.files.contains_key(path) {
+                return Some(0);
+            }
+            index.metadata.get(path).map(|m| m.size)
+        };
+
+        let mut paths: Vec<String> = Vec::new();
+        let (changed_files, deleted_files) = self.diff(b);
+        for path in changed_files.into_iter().chain(deleted_files) {
+            if let (Some(old), Some(new)) = (size(self, &path), size(b, &path)) {
+                if old.abs_diff(new) > min_delta {
+                    paths.push(path);
+                }
+            }
+        }
+
+        paths.sort();
+        paths
+    }
+
+    /// Returns the (sorted) paths indexed by both self & b, whatever their checksum.
+    pub fn intersect(&self, b: &Index) -> Vec<String> {
+        let mut paths: Vec<String> = self
+            .files
+            .keys()
+            .filter(|path| b.files.contains_key(*path))
+            .cloned()
+            .collect();
+        paths.sort();
+        paths
+    }
+
+    /// Check that the index contains exactly given paths, no more no less,
+    /// f.e to verify a deployment.
+    /// return the (sorted) expected paths which are not indexed
+    /// and the (sorted) indexed paths which are not expected.
+    pub fn expect_exactly(&self, paths: &[&str]) -> (Vec<String>, Vec<String>) {
+        let expected: HashSet<&str> = paths.iter().copied().collect();
+
+        let mut missing: Vec<String> = expected
+            .iter()
+            .filter(|path| !self.files.contains_key(**path))
+            .map(|path| path.to_string())
+            .collect();
+        let mut unexpected: Vec<String> = self
+            .files
+            .keys()
+            .filter(|path| !expected.contains(path.as_str()))
+            .cloned()
+            .collect();
+
+        missing.sort();
+        unexpected.sort();
+        (missing, unexpected)
+    }
+
+    /// Returns a copy of the index without the recorded empty directories
+    /// (see `ComputeOptions::empty_directories`), the file entries being kept as is.
+    pub fn prune_empty(&self) -> Index {
+        Index {
+            empty_directories: Vec::new(),
+            ..self.clone()
+        }
+    }
+
+    /// Split the index into n disjoint indexes of roughly the same number of files,
+    /// f.e to verify or transfer them in parallel. The shard of a file only depends on
+    /// its path, and the hard links follow the file they point to.
+    /// The empty directories (if recorded) are part of the first shard.
+    pub fn shard(&self, n: usize) -> Vec<Index> {
+        let n = n.max(1);
+        let shard_of = |path: &str| {
+            let mut hasher = sha1::Sha1::new();
+            hasher.update(path.as_bytes());
+            let digest = hasher.finalize();
+            let hash = digest[..8]
+                .iter()
+                .fold(0u64, |hash, byte| hash << 8 | *byte as u64);
+            (hash % n as u64) as usize
+        };
+
+        let mut shards: Vec<Index> = (0..n).map(|_| self.empty_copy()).collect();
+        for (path, hash) in &self.files {
+            let shard = &mut shards[shard_of(path)];
+            shard.files.insert(path.to_string(), hash.to_string());
+            if let Some(metadata) = self.metadata.get(path) {
+                shard.metadata.insert(path.to_string(), metadata.clone());
+            }
+            if let Some(chunks) = self.chunks.get(path) {
+                shard.chunks.insert(path.to_string(), chunks.clone());
+            }
+            if let Some(time) = self.first_seen.get(path) {
+                shard.first_seen.insert(path.to_string(), *time);
+            }
+            if let Some(label) = self.labels.get(path) {
+                shard.labels.insert(path.to_string(), label.to_string());
+            }
+        }
+        for (path, target) in &self.links {
+            if self.files.contains_key(target) {
+                shards[shard_of(target)]
+                    .links
+                    .insert(path.to_string(), target.to_string());
+            }
+        }
+        shards[0].empty_directories = self.empty_directories.clone();
+
+        shards
+    }
+
+    /// Returns a copy of the index without any entry (nor directory listing).
+    fn empty_copy(&self) -> Index {
+        Index {
+            directory: self.directory.clone(),
+            files: HashMap::new(),
+            metadata: HashMap::new(),
+            links: HashMap::new(),
+            conflicts: self.conflicts.clone(),
+            broken_links: self.broken_links.clone(),
+            read_only: self.read_only,
+            algorithm: self.algorithm.to_string(),
+            listings: HashMap::new(),
+            computed_at: self.computed_at,
+            chunks: HashMap::new(),
+            first_seen: HashMap::new(),
+            labels: HashMap::new(),
+            salted: self.salted,
+            empty_directories: Vec::new(),
+        }
+    }
+
+    /// Find the files of b whose content already exists somewhere in self,
+    /// f.e to hard link them instead of copying them.
+    /// The checksums computed using different algorithms (or salts) never match.
+    /// return the paths of b mapped to the (sorted) paths of self with the same checksum.
+    pub fn shared_content(&self, b: &Index) -> HashMap<String, Vec<String>> {
+        let mut shared: HashMap<String, Vec<String>> = HashMap::new();
+        if self.hash_label() != b.hash_label() {
+            return shared;
+        }
+
+        let mut paths_by_hash: HashMap<&String, Vec<String>> = HashMap::new();
+        for (path, hash) in &self.files {
+            paths_by_hash
+                .entry(hash)
+                .or_default()
+                .push(path.to_string());
+        }
+        for paths in paths_by_hash.values_mut() {
+            paths.sort();
+        }
+
+        for (path, hash) in &b.files {
+            if let Some(paths) = paths_by_hash.get(hash) {
+                shared.insert(path.to_string(), paths.clone());
+            }
+        }
+
+        shared
+    }
+
+    /// Compute the difference between the indexes self & b
+    /// return a result holding the added, modified & deleted files.
+    pub fn diff_result(&self, b: &Index) -> DiffResult {
+        DiffResult::new(self, b)
+    }
+
+    /// Compute the difference between the indexes self & b
+    /// return the kind of change of each changed file (see `DiffResult::paths`).
+    pub fn diff_paths(&self, b: &Index) -> HashMap<String, ChangeType> {
+        self.diff_result(b).paths()
+    }
+
+    /// Compute the operations needed to make the directory indexed by self
+    /// a mirror of the one indexed by b (see `MirrorDiff`).
+    pub fn mirror_diff(&self, b: &Index) -> MirrorDiff {
+        MirrorDiff::new(self, b)
+    }
+
+    /// Compute the difference between the indexes self & b
+    /// and write a JSON summary of it to given writer (see `DiffResult::write_json`).
+    pub fn diff_summary_json<W: Write>(&self, b: &Index, w: W) -> Result<(), Box<dyn Error>> {
+        self.diff_result(b).write_json(w)
+    }
+
+    /// Compute the current state of the index directory and diff against it
+    /// return the changed files (new, modified) and the deleted.
+    pub fn diff_directory(&self) -> Result<(Vec<String>, Vec<String>), Box<dyn Error>> {
+        self.diff_directory_with_options(&ComputeOptions::default())
+    }
+
+    /// Like `Index::diff_directory`, computing the current state using given options,
+    /// which should be the ones the index has been computed with (see `Index::rehash`).
+    pub fn diff_directory_with_options(
+        &self,
+        options: &ComputeOptions,
+    ) -> Result<(Vec<String>, Vec<String>), Box<dyn Error>> {
+        self.check_options(options)?;
+        let (current_index, _) = Index::compute_with_options(&self.directory, options)?;
+        self.checked_diff(&current_index)
+    }
+
+    /// Compare the index against the current state of its directory using only
+    /// the size & modification time of the files, without reading their content.
+    /// A file whose size or modification time is unknown is considered changed.
+    /// return the changed files (new, modified) and the deleted.
+    pub fn quick_diff_directory(&self) -> Result<(Vec<String>, Vec<String>), Box<dyn Error>> {
+        let mut changed_files: Vec<String> = Vec::new();
+        let mut walked: HashSet<String> = HashSet::new();
+
+        walk(
+            &self.directory,
+            &ComputeOptions::default(),
+            true,
+            |_, metadata, key| {
+                let current = FileMetadata::from(metadata);
+                let unchanged = match self.metadata.get(&key) {
+                    Some(previous) => previous.modified.is_some() && previous == &current,
+                    None => false,
+                };
+                if !unchanged {
+                    changed_files.push(key.to_string());
+                }
+                walked.insert(key);
+                Ok(())
+            },
+        )?;
+
+        let deleted_files: Vec<String> = self
+            .files
+            .keys()
+            .filter(|path| !walked.contains(*path))
+            .cloned()
+            .collect();
+
+        Ok((changed_files, deleted_files))
+    }
+
+    /// Drop the entries whose file no longer exists on the disk.
+    /// This is cheaper than computing the index again since files are not read.
+    /// return the pruned index and the (sorted) removed paths.
+    pub fn prune(&self) -> Result<(Index, Vec<String>), Box<dyn Error>> {
+        let mut index = self.clone();
+        let mut pruned: Vec<String> = Vec::new();
+
+        for path in self.files.keys() {
+            if !self.exists(path)? {
+                index.forget(path);
+                pruned.push(path.to_string());
+            }
+        }
+
+        for path in self.links.keys() {
+            if !self.exists(path)? {
+                index.links.remove(path);
+                index.remove_listings(path);
+                pruned.push(path.to_string());
+            }
+        }
+
+        pruned.sort();
+        Ok((index, pruned))
+    }
+
+    /// Returns `true` if the file at given (relative) path exists.
+    fn exists(&self, path: &str) -> io::Result<bool> {
+        match fs::metadata(self.directory.join(path)) {
+            Ok(_) => Ok(true),
+            Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(false),
+            Err(e) => Err(e),
+        }
+    }
+
+    /// Mark the index as read-only: saving it will fail instead of
+    /// overwriting the index file. Useful for verification-only runs.
+    pub fn read_only(mut self) -> Index {
+        self.read_only = true;
+        self
+    }
+
+    /// Returns `true` if the index is read-only.
+    pub fn is_read_only(&self) -> bool {
+        self.read_only
+    }
+
+    /// Returns the number of files in the index.
+    pub fn len(&self) -> usize {
+        self.files.len()
+    }
+
+    /// Returns `true` if the index contains no files.
+    pub fn is_empty(&self) -> bool {
+        self.files.is_empty()
+    }
+
+    /// Returns the path which the index is computed for.
+    pub fn path(&self) -> PathBuf {
+        self.directory.clone()
+    }
+
+    /// Returns a copy of the index for given directory, keeping the same (relative) keys,
+    /// f.e to reuse the index of a tree which has been moved.
+    pub fn rebase<P: AsRef<Path>>(&self, directory: P) -> Index {
+        Index {
+            directory: directory.as_ref().to_path_buf(),
+            ..self.clone()
+        }
+    }
+
+    /// Returns the filesystem path of the file indexed under given (relative) key.
+    pub fn abs_path(&self, rel: &str) -> PathBuf {
+        self.directory.join(rel)
+    }
+
+    /// Returns the key of the file at given filesystem path,
+    /// which must be located in the index directory.
+    pub fn rel_path<P: AsRef<Path>>(&self, abs: P) -> Result<String, Box<dyn Error>> {
+        match abs.as_ref().strip_prefix(&self.directory) {
+            Ok(path) => Ok(to_slash(path).to_string()),
+            Err(_) => Err(format!(
+                "{} is not in {}",
+                abs.as_ref().display(),
+                self.directory.display()
+            )
+            .into()),
+        }
+    }
+
+    pub fn files(&self) -> &HashMap<String, String> {
+        &self.files
+    }
+
+    /// Returns when the index has been computed, if known
+    /// (the indexes saved by older versions do not record it).
+    pub fn computed_at(&self) -> Option<SystemTime> {
+        self.computed_at
+    }
+
+    /// Returns the (sorted) entries whose stored modification time is after given time,
+    /// f.e the files modified since the index has been computed the last time.
+    /// The entries whose modification time is unknown are never returned.
+    pub fn changed_since(&self, time: SystemTime) -> Vec<String> {
+        let mut changed: Vec<String> = self
+            .files
+            .keys()
+            .filter(|path| match self.metadata.get(*path) {
+                Some(metadata) => matches!(metadata.modified, Some(modified) if modified > time),
+                None => false,
+            })
+            .cloned()
+            .collect();
+        changed.sort();
+        changed
+    }
+
+    /// Returns the label of the algorithm used to compute the checksums.
+    pub fn algorithm(&self) -> &str {
+        &self.algorithm
+    }
+
+    /// Returns the label of the algorithm, telling whether the checksums are salted,
+    /// so that only the comparable checksums share the same label.
+    fn hash_label(&self) -> String {
+        hash_label(&self.algorithm, self.salted)
+    }
+
+    /// Returns an error if the checksums computed using given options
+    /// cannot be compared against the ones of the index.
+    pub(crate) fn check_options(&self, options: &ComputeOptions) -> Result<(), AlgorithmMismatch> {
+        let label = hash_label(options.algorithm(), options.salt.is_some());
+        if self.hash_label() != label {
+            return Err(AlgorithmMismatch {
+                a: self.hash_label(),
+                b: label,
+            });
+        }
+
+        Ok(())
+    }
+
+    /// Returns `true` if the checksums have been computed using a secret salt
+    /// (see `ComputeOptions::salt`).
+    pub fn is_salted(&self) -> bool {
+        self.salted
+    }
+
+    /// Returns the metadata of the file at given path, if known.
+    pub fn metadata(&self, path: &str) -> Option<&FileMetadata> {
+        self.metadata.get(path)
+    }
+
+    /// Returns the total size in bytes of the indexed files (whose metadata is known).
+    pub fn total_size(&self) -> u64 {
+        self.metadata.values().map(|m| m.size).sum()
+    }
+
+    /// Returns the hard links detected while computing the index,
+    /// associated with the indexed path they are linked to.
+    pub fn links(&self) -> &HashMap<String, String> {
+        &self.links
+    }
+
+    /// Returns the hash of the names of the immediate children of given directory
+    /// (an empty string being the root), if the listings have been computed.
+    /// The listing of a directory changes when a file is added to or removed from it.
+    pub fn listing(&self, directory: &str) -> Option<&str> {
+        self.listings.get(directory).map(|s| s.as_str())
+    }
+
+    /// Returns the checksums of the content-defined chunks of the file at given path,
+    /// if they have been computed (see `ComputeOptions::chunking`).
+    pub fn chunks(&self, path: &str) -> Option<&[String]> {
+        self.chunks.get(path).map(|c| c.as_slice())
+    }
+
+    /// Returns when the file at given path has been indexed for the first time,
+    /// if it has been recorded (see `ComputeOptions::first_seen`).
+    pub fn first_seen(&self, path: &str) -> Option<SystemTime> {
+        self.first_seen.get(path).copied()
+    }
+
+    /// Returns the label attached to the entry at given path, if any.
+    pub fn label(&self, path: &str) -> Option<&str> {
+        self.labels.get(path).map(|l| l.as_str())
+    }
+
+    /// Attach given label (f.e "generated") to the entry at given path,
+    /// replacing the previous one. An empty label removes it.
+    /// The labels are saved with the index but ignored when diffing.
+    pub fn set_label(&mut self, path: &str, label: &str) -> Result<(), Box<dyn Error>> {
+        if !self.files.contains_key(path) {
+            return Err(format!("no such entry: {}", path).into());
+        }
+        if label.contains('\n') {
+            return Err("a label cannot contain a newline".into());
+        }
+
+        if label.is_empty() {
+            self.labels.remove(path);
+        } else {
+            self.labels.insert(path.to_string(), label.to_string());
+        }
+        Ok(())
+    }
+
+    /// Returns the keys shared by many files while computing the index.
+    /// Only one of these files is indexed under the key.
+    pub fn conflicts(&self) -> &[String] {
+        &self.conflicts
+    }
+
+    /// Returns the symbolic links skipped while computing the index
+    /// because their target does not exist (only when following the links).
+    pub fn broken_links(&self) -> &[String] {
+        &self.broken_links
+    }
+
+    /// Returns the (sorted) directories without any child,
+    /// if recorded (see `ComputeOptions::empty_directories`).
+    pub fn empty_directories(&self) -> &[String] {
+        &self.empty_directories
+    }
+
+    /// Returns the (sorted) paths of the files having given checksum.
+    pub fn paths_with_checksum(&self, checksum: &str) -> Vec<String> {
+        let mut paths: Vec<String> = self
+            .files
+            .iter()
+            .filter(|(_, hash)| *hash == checksum)
+            .map(|(path, _)| path.to_string())
+            .collect();
+        paths.sort();
+
+        paths
+    }
+
+    /// Hash again the file at given (relative) path and update its entry,
+    /// or remove the entry if the file no longer exists.
+    pub fn update(&mut self, path: &str) -> Result<(), Box<dyn Error>> {
+        self.update_with_options(path, &ComputeOptions::default())
+    }
+
+    /// Like `Index::update`, hashing the file using given options, which should be
+    /// the ones the index has been computed with (see `Index::rehash`).
+    pub fn update_with_options(
+        &mut self,
+        path: &str,
+        options: &ComputeOptions,
+    ) -> Result<(), Box<dyn Error>> {
+        self.check_options(options)?;
+        // the other paths of a hard linked file are not hashed
+        if self.links.contains_key(path) {
+            return Err(format!("unable to update a hard link: {}", path).into());
+        }
+
+        let file_path = self.directory.join(path);
+        let metadata = match fs::metadata(&file_path) {
+            Ok(metadata) => metadata,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => return self.remove(path),
+            Err(e) => return Err(e.into()),
+        };
+
+        // adding a file changes the listing of its directories
+        if !self.files.contains_key(path) {
+            self.remove_listings(path);
+        }
+        match options.avg_chunk {
+            Some(avg_chunk) => {
+                let file_chunks = chunk_reader(
+                    options.open(&file_path)?,
+                    avg_chunk,
+                    options.salt_prefix().as_bytes(),
+                )?;
+                self.chunks.insert(path.to_string(), file_chunks);
+            }
+            None => {
+                self.chunks.remove(path);
+            }
+        }
+
+        let hash = hash_entry(options, &file_path, path, &metadata)?;
+        self.metadata
+            .insert(path.to_string(), FileMetadata::from(&metadata));
+        self.files.insert(path.to_string(), hash);
+        Ok(())
+    }
+
+    /// Hash again each indexed file, keeping everything else (f.e the size & modification
+    /// time of the files) as is. The files are hashed using given options, which should be
+    /// the ones the index has been computed with (f.e `ComputeOptions::path_in_digest`),
+    /// otherwise each checksum would change. The keys are expected to be the paths
+    /// of the files relative to the directory.
+    /// return the rehashed index.
+    pub fn rehash(&self, options: &ComputeOptions) -> Result<Index, Box<dyn Error>> {
+        self.check_options(options)?;
+
+        let mut index = self.clone();
+        for (path, hash) in index.files.iter_mut() {
+            let file_path = self.abs_path(path);
+
+            // the sentinel of an empty file is kept as long as the file is empty
+            if hash == EMPTY_CHECKSUM && fs::metadata(&file_path)?.len() == 0 {
+                continue;
+            }
+
+            let current_hash = hash_file(options, &file_path, path)?;
+            if *hash != current_hash {
+                // the chunks of a file whose content changed are outdated
+                index.chunks.remove(path);
+                *hash = current_hash;
+            }
+        }
+
+        Ok(index)
+    }
+
+    /// Refresh the size & modification time of the entry at given path,
+    /// without hashing the file again: the content is assumed to be unchanged.
+    pub fn touch(&mut self, path: &str) -> Result<(), Box<dyn Error>> {
+        if !self.files.contains_key(path) {
+            return Err(format!("no such entry: {}", path).into());
+        }
+
+        let metadata = fs::metadata(self.directory.join(path))?;
+        self.metadata
+            .insert(path.to_string(), FileMetadata::from(&metadata));
+        Ok(())
+    }
+
+    /// Copy the entry at given path (and everything known about it) from given index,
+    /// f.e to keep an entry whose deletion has been denied.
+    pub(crate) fn copy_entry(&mut self, from: &Index, path: &str) {
+        let hash = match from.files.get(path) {
+            Some(hash) => hash,
+            None => return,
+        };
+
+        // adding a file changes the listing of its directories
+        if !self.files.contains_key(path) {
+            self.remove_listings(path);
+        }
+        self.files.insert(path.to_string(), hash.to_string());
+        if let Some(metadata) = from.metadata.get(path) {
+            self.metadata.insert(path.to_string(), metadata.clone());
+        }
+        if let Some(file_chunks) = from.chunks.get(path) {
+            self.chunks.insert(path.to_string(), file_chunks.clone());
+        }
+        if let Some(time) = from.first_seen.get(path) {
+            self.first_seen.insert(path.to_string(), *time);
+        }
+        if let Some(label) = from.labels.get(path) {
+            self.labels.insert(path.to_string(), label.to_string());
+        }
+    }
+
+    pub fn remove(&mut self, path: &str) -> Result<(), Box<dyn Error>> {
+        self.forget(path);
+        Ok(())
+    }
+
+    /// Drop everything known about given path.
+    fn forget(&mut self, path: &str) {
+        if self.files.remove(path).is_some() {
+            self.remove_listings(path);
+        }
+        self.metadata.remove(path);
+        self.chunks.remove(path);
+        self.first_seen.remove(path);
+        self.labels.remove(path);
+    }
+
+    /// Remove the (outdated) listings of the directories containing given path.
+    fn remove_listings(&mut self, path: &str) {
+        let mut path = path;
+        while let Some(i) = path.rfind('/') {
+            path = &path[..i];
+            self.listings.remove(path);
+        }
+        self.listings.remove("");
+    }
+}
+
+/// The outcome of a directory walk.
+struct Walked {
+    // the number of ignored files
+    ignored: usize,
+    // the broken symbolic links which have been skipped
+    broken_links: Vec<String>,
+    // the (sorted) directories without any child, if recorded
+    empty_directories: Vec<String>,
+}
+
+/// Walk given directory and call `f` for each file that should be indexed,
+/// with its metadata and the key to use in the index.
+/// The diagnostics & the walked directories are only reported if `report` is `true`,
+/// so that the directory can be walked many times while computing a single index.
+fn walk<F>(
+    directory: &Path,
+    options: &ComputeOptions,
+    report: bool,
+    mut f: F,
+) -> Result<Walked, Box<dyn Error>>
+where
+    F: FnMut(&walkdir::DirEntry, &fs::Metadata, String) -> Result<(), Box<dyn Error>>,
+{
+    // try to load .osyncignore (or .osyncignore.gz) file, unless a custom matcher is used
+    // the lines ending with a slash ignore whole directories
+    let mut ignored_files: HashSet<String> = HashSet::new();
+    let mut ignored_directories: Vec<String> = Vec::new();
+    let ignore_file = if options.matcher.is_some() {
+        None
+    } else {
+        read_ignore_file(directory)?
+    };
+    if let Some((_, patterns)) = ignore_file {
+        for line in patterns {
+            // the patterns are matched against slash separated paths
+            let line = line.replace('\\', "/");
+            if line.ends_with('/') {
+                ignored_directories.push(line.trim_end_matches('/').to_string());
+            }
+            ignored_files.insert(line);
+        }
+    }
+
+    // do not upload .osync(ignore)(.gz) files
+    ignored_files.insert(INDEX_FILE.to_string());
+    ignored_files.insert(IGNORE_FILE.to_string());
+    if directory.join(GZIPPED_IGNORE_FILE).is_file() {
+        ignored_files.insert(GZIPPED_IGNORE_FILE.to_string());
+    }
+
+    let ignored_files = ExactMatcher(ignored_files);
+    let is_ignored = |path: &str| {
+        ignored_files.is_match(path)
+            || matches!(&options.matcher, Some(matcher) if matcher.is_match(path))
+    };
+
+    let warn = |message: &str| {
+        if report {
+            options.warn(message);
+        }
+    };
+
+    // the .gitignore files are loaded while walking the directory,
+    // and ignored directories are not walked at all
+    let mut gitignore = GitIgnore::new();
+    // the depth of the walked directories which are excluded (true) or kept (false),
+    // the deepest one deciding whether the files are indexed
+    let mut scopes: Vec<(usize, bool)> = Vec::new();
+    // the walked directories whose files are excluded
+    let excluded_directories: RefCell<HashSet<PathBuf>> = RefCell::new(HashSet::new());
+    let filter = |entry: &walkdir::DirEntry| {
+        let local_path = match entry.path().strip_prefix(directory) {
+            Ok(path) => to_slash(path),
+            Err(_) => return true,
+        };
+        let local_path: &str = &local_path;
+        let is_dir = entry.file_type().is_dir();
+
+        // a directory pattern without slash matches the directory anywhere in the tree
+        let ignored = (is_dir && entry.depth() > 0 && {
+            let name = entry.file_name().to_str().unwrap_or_default();
+            ignored_directories
+                .iter()
+                .any(|dir| dir == local_path || (!dir.contains('/') && dir == name))
+        }) || (options.gitignore && gitignore.is_ignored(local_path, is_dir));
+
+        if options.gitignore && is_dir && !ignored {
+            if let Ok(content) = fs::read_to_string(entry.path().join(GITIGNORE_FILE)) {
+                gitignore.add(local_path, &content);
+            }
+        }
+
+        if !options.keep_markers {
+            return !ignored;
+        }
+
+        // leave the scopes of the directories walked so far
+        while matches!(scopes.last(), Some((depth, _)) if *depth >= entry.depth()) {
+            scopes.pop();
+        }
+        let excluded = matches!(scopes.last(), Some((_, true)));
+
+        if !is_dir {
+            return !ignored && !excluded;
+        }
+
+        if entry.path().join(KEEP_FILE).is_file() {
+            scopes.push((entry.depth(), false));
+        } else if ignored || excluded {
+            if !excluded {
+                scopes.push((entry.depth(), true));
+            }
+            excluded_directories
+                .borrow_mut()
+                .insert(entry.path().to_path_buf());
+        }
+
+        true
+    };
+
+    // the canonical paths of the files already walked
+    let canonical_root = if options.canonical_paths {
+        Some(fs::canonicalize(directory)?)
+    } else {
+        None
+    };
+    let mut canonical_paths: HashSet<PathBuf> = HashSet::new();
+    let mut broken_links: Vec<String> = Vec::new();
+    // directory -> number of children which are not ignored
+    let mut children: HashMap<String, usize> = HashMap::new();
+
+    // the absolute path of the walked directory & of the current directory
+    let cwd = if options.cwd_relative {
+        let cwd = env::current_dir()?;
+        Some((
+            cwd.join(canonical_root.as_deref().unwrap_or(directory)),
+            cwd,
+        ))
+    } else {
+        None
+    };
+
+    // when following links walkdir reports loops & broken links as errors,
+    // they are skipped like any other unreadable entry.
+    // the entries are sorted so that the walk order (and therefore which file wins
+    // when many files share the same key or inode) does not change across runs
+    let walker = WalkDir::new(directory)
+        .follow_links(options.follow_links || options.canonical_paths)
+        .sort_by(|a, b| a.file_name().cmp(b.file_name()));
+    for entry in walker.into_iter().filter_entry(filter) {
+        let entry = match entry {
+            Ok(entry) => entry,
+            Err(e) => {
+                match e.path().filter(|path| is_broken_link(path)) {
+                    Some(path) => {
+                        if let Ok(local_path) = path.strip_prefix(directory) {
+                            let local_path = to_slash(local_path);
+                            if !is_ignored(&local_path) {
+                                warn(&format!("skipping broken link: {}", local_path));
+                                broken_links.push(local_path.to_string());
+                            }
+                        }
+                    }
+                    None => warn(&format!("skipping entry: {}", e)),
+                }
+                continue;
+            }
+        };
+        let local_path = entry.path().strip_prefix(directory)?;
+        let metadata = entry.metadata().unwrap();
+
+        if metadata.is_dir() {
+            if let Some(callback) = options.on_directory.as_ref().filter(|_| report) {
+                let children = fs::read_dir(entry.path()).map_or(0, |e| e.count());
+                callback(&to_slash(local_path), children);
+            }
+        }
+
+        // the lock & temporary files only exist while another process is working on the directory
+        if local_path == Path::new(LOCK_FILE) || local_path == Path::new(TEMP_INDEX_FILE) {
+            continue;
+        }
+
+        // a directory is empty if all its children are ignored
+        if options.empty_directories && entry.depth() > 0 {
+            let is_child = if metadata.is_dir() {
+                !excluded_directories.borrow().contains(entry.path())
+            } else {
+                !is_ignored(&to_slash(local_path))
+            };
+            if is_child {
+                if metadata.is_dir() {
+                    children.insert(to_slash(local_path).to_string(), 0);
+                }
+                let parent = local_path.parent().map(to_slash).unwrap_or_default();
+                if let Some(count) = children.get_mut(parent.as_ref()) {
+                    *count += 1;
+                }
+            }
+        }
+
+        if metadata.is_file() && !is_ignored(&to_slash(local_path)) {
+            if options.is_recent(&metadata)? {
+                warn(&format!(
+                    "skipping recently modified file: {}",
+                    to_slash(local_path)
+                ));
+                continue;
+            }
+            if options.is_excluded_inode(&metadata) || options.is_foreign(&metadata) {
+                continue;
+            }
+
+            let path = to_slash(local_path);
+            if options.regex_excludes.iter().any(|re| re.is_match(&path)) {
+                continue;
+            }
+            if !options.has_magic(entry.path())? {
+                continue;
+            }
+            if metadata.len() == 0 && options.empty_files == Some(EmptyFiles::Skip) {
+                continue;
+            }
+
+            let mut local_path = local_path.to_path_buf();
+            if let Some(root) = &canonical_root {
+                let path = fs::canonicalize(entry.path())?;
+                if let Ok(path) = path.strip_prefix(root) {
+                    local_path = path.to_path_buf();
+                }
+
+                // the file has already been indexed under another name
+                if !canonical_paths.insert(local_path.clone()) {
+                    continue;
+                }
+            }
+
+            if let Some((root, cwd)) = &cwd {
+                local_path = relative_path(cwd, &root.join(&local_path));
+            }
+
+            let local_path = to_slash(&local_path);
+            let key = match &options.path_mapper {
+                Some(mapper) => mapper(&local_path),
+                None => local_path.to_string(),
+            };
+            if key.is_empty() {
+                continue;
+            }
+            let key = match options.normalization {
+                Some(normalization) => normalization.apply(&key),
+                None => key,
+            };
+
+            f(&entry, &metadata, key)?;
+        }
+    }
+
+    let mut empty_directories: Vec<String> = children
+        .into_iter()
+        .filter(|(_, count)| *count == 0)
+        .map(|(directory, _)| directory)
+        .collect();
+    empty_directories.sort();
+
+    Ok(Walked {
+        ignored: ignored_files.0.len(),
+        broken_links,
+        empty_directories,
+    })
+}
+
+// the name of an ignore file and its patterns
+type IgnoreFile = (&'static str, Vec<String>);
+
+/// Read the patterns of the .osyncignore (or .osyncignore.gz) file of given directory
+/// return the name of the file read and its patterns, if there's one.
+pub(crate) fn read_ignore_file(directory: &Path) -> Result<Option<IgnoreFile>, Box<dyn Error>> {
+    let (name, file): (&str, Box<dyn Read>) = match File::open(directory.join(IGNORE_FILE)) {
+        Ok(file) => (IGNORE_FILE, Box::new(file)),
+        Err(_) => match File::open(directory.join(GZIPPED_IGNORE_FILE)) {
+            Ok(file) => (GZIPPED_IGNORE_FILE, Box::new(GzDecoder::new(file))),
+            Err(_) => return Ok(None),
+        },
+    };
+
+    Ok(Some((name, read_lines(file)?)))
+}
+
+/// Returns `true` if given path is a symbolic link whose target does not exist.
+fn is_broken_link(path: &Path) -> bool {
+    let is_link =
+        matches!(fs::symlink_metadata(path), Ok(metadata) if metadata.file_type().is_symlink());
+    is_link && matches!(fs::metadata(path), Err(e) if e.kind() == io::ErrorKind::NotFound)
+}
+
+/// Returns the length (in bytes) of the longest common prefix of given strings.
+fn shared_prefix_len(a: &str, b: &str) -> usize {
+    let mut len = a.bytes().zip(b.bytes()).take_while(|(a, b)| a == b).count();
+    // do not split a character
+    while !b.is_char_boundary(len) {
+        len -= 1;
+    }
+    len
+}
+
+/// Returns given path relative to given base directory, both being absolute,
+/// using `..` to walk up from the base.
+fn relative_path(base: &Path, path: &Path) -> PathBuf {
+    let base: Vec<Component> = base.components().collect();
+    let path: Vec<Component> = path.components().collect();
+    let common = base.iter().zip(&path).take_while(|(a, b)| a == b).count();
+
+    let mut relative = PathBuf::new();
+    for _ in common..base.len() {
+        relative.push("..");
+    }
+    for component in &path[common..] {
+        relative.push(component);
+    }
+
+    relative
+}
+
+/// Returns given (relative) path using forward slashes as separator,
+/// so that the keys and the ignore patterns do not depend on the platform.
+fn to_slash(path: &Path) -> Cow<'_, str> {
+    let path = path.to_str().unwrap();
+    if MAIN_SEPARATOR == '/' {
+        Cow::Borrowed(path)
+    } else {
+        Cow::Owned(path.replace(MAIN_SEPARATOR, "/"))
+    }
+}
+
+/// Decode a path escaped by a coreutils checksum tool.
+fn unescape_sumfile_path(path: &str) -> String {
+    let mut unescaped = String::with_capacity(path.len());
+    let mut chars = path.chars();
+    while let Some(c) = chars.next() {
+        if c != '\\' {
+            unescaped.push(c);
+            continue;
+        }
+
+        match chars.next() {
+            Some('n') => unescaped.push('\n'),
+            Some(c) => unescaped.push(c),
+            None => unescaped.push('\\'),
+        }
+    }
+
+    unescaped
+}
+
+/// Compute the listing of each directory containing one of given paths:
+/// the hash of the sorted names of its immediate children (files & directories).
+fn directory_listings<'a, I>(paths: I) -> io::Result<HashMap<String, String>>
+where
+    I: Iterator<Item = &'a String>,
+{
+    let mut children: HashMap<&str, BTreeSet<&str>> = HashMap::new();
+    for path in paths {
+        let mut path = path.as_str();
+        loop {
+            let (parent, name) = match path.rfind('/') {
+                Some(i) => (&path[..i], &path[i + 1..]),
+                None => ("", path),
+            };
+            children.entry(parent).or_default().insert(name);
+            if parent.is_empty() {
+                break;
+            }
+            path = parent;
+        }
+    }
+
+    let mut listings: HashMap<String, String> = HashMap::new();
+    for (directory, names) in children {
+        let names: Vec<&str> = names.into_iter().collect();
+        listings.insert(
+            directory.to_string(),
+            hash_reader(names.join("\n").as_bytes())?,
+        );
+    }
+
+    Ok(listings)
+}
+
+/// Compute the digest of the file at given path, indexed under given key.
+pub(crate) fn hash_file(options: &ComputeOptions, path: &Path, key: &str) -> io::Result<String> {
+    let mut prefix = options.salt_prefix();
+    if options.path_in_digest {
+        prefix += format!("{}\0", key).as_str();
+    }
+    let xattrs = if options.xattrs {
+        read_xattrs(path)?
+    } else {
+        Vec::new()
+    };
+
+    let reader = options.open(path)?;
+    hash_reader_with(
+        options.new_hasher(),
+        prefix.as_bytes().chain(reader).chain(xattrs.as_slice()),
+        options.buffer_size.unwrap_or(DEFAULT_BUFFER_SIZE),
+    )
+}
+
+/// Compute the checksum of the file at given path, indexed under given key,
+/// like `hash_file` except that the empty files may not be hashed at all.
+fn hash_entry(
+    options: &ComputeOptions,
+    path: &Path,
+    key: &str,
+    metadata: &fs::Metadata,
+) -> io::Result<String> {
+    if metadata.len() == 0 && options.empty_files == Some(EmptyFiles::Sentinel) {
+        return Ok(EMPTY_CHECKSUM.to_string());
+    }
+
+    hash_file(options, path, key)
+}
+
+/// Compute the SHA-1 of the content of given reader.
+pub(crate) fn hash_reader<R: Read>(reader: R) -> io::Result<String> {
+    hash_reader_with(
+        Box::new(Sha1Hasher(sha1::Sha1::new())),
+        reader,
+        DEFAULT_BUFFER_SIZE,
+    )
+}
+
+/// Compute the checksum of the content of given reader using given hasher,
+/// reading it by chunks of given size.
+fn hash_reader_with<R: Read>(
+    mut hasher: Box<dyn Hasher>,
+    mut reader: R,
+    buffer_size: usize,
+) -> io::Result<String> {
+    let mut buf = vec![0; buffer_size];
+    loop {
+        let n = reader.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+        hasher.update(&buf[..n]);
+    }
+
+    Ok(hasher
+        .finalize()
+        .iter()
+        .map(|b| format!("{:02x}", b))
+        .collect())
+}
+
+/// Returns the label of given algorithm, with or without salt.
+fn hash_label(algorithm: &str, salted: bool) -> String {
+    if salted {
+        format!("{} (salted)", algorithm)
+    } else {
+        algorithm.to_string()
+    }
+}
+
+/// Split the content of given reader into variable-length chunks of given average size,
+/// cutting where a rolling (Gear) hash of the last bytes matches a pattern so that the
+/// boundaries only depend on the content. return the SHA-1 of each chunk,
+/// prefixed by given salt.
+fn chunk_reader<R: Read>(mut reader: R, avg_chunk: usize, salt: &[u8]) -> io::Result<Vec<String>> {
+    let avg_chunk = avg_chunk.max(64).next_power_of_two();
+    let (min_chunk, max_chunk) = (avg_chunk / 4, avg_chunk * 4);
+    // a boundary is found when the top bits of the hash are all zero
+    let bits = avg_chunk.trailing_zeros();
+    let gear = gear_table();
+
+    let mut chunks = Vec::new();
+    let mut chunk: Vec<u8> = Vec::with_capacity(max_chunk);
+    let mut hash: u64 = 0;
+    let mut buf = vec![0; DEFAULT_BUFFER_SIZE];
+    loop {
+        let n = reader.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+
+        for &b in &buf[..n] {
+            chunk.push(b);
+            hash = (hash << 1).wrapping_add(gear[b as usize]);
+            if (chunk.len() >= min_chunk && hash >> (64 - bits) == 0) || chunk.len() >= max_chunk {
+                chunks.push(hash_reader(salt.chain(chunk.as_slice()))?);
+                chunk.clear();
+            }
+        }
+    }
+
+    if !chunk.is_empty() {
+        chunks.push(hash_reader(salt.chain(chunk.as_slice()))?);
+    }
+
+    Ok(chunks)
+}
+
+/// Returns the (pseudo-random, but fixed) values mixed into the rolling hash for each byte.
+fn gear_table() -> [u64; 256] {
+    let mut table = [0; 256];
+    let mut state: u64 = 0;
+    for value in table.iter_mut() {
+        // SplitMix64
+        state = state.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = state;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        *value = z ^ (z >> 31);
+    }
+    table
+}
+
+/// Returns the device & inode of given file if it has more than one hard link.
+#[cfg(unix)]
+fn hard_link_inode(metadata: &fs::Metadata) -> Option<(u64, u64)> {
+    use std::os::unix::fs::MetadataExt;
+
+    if metadata.nlink() > 1 {
+        Some((metadata.dev(), metadata.ino()))
+    } else {
+        None
+    }
+}
+
+#[cfg(not(unix))]
+fn hard_link_inode(_metadata: &fs::Metadata) -> Option<(u64, u64)> {
+    None
+}
+
+/// Read the extended attributes of given file, sorted by name
+/// and serialized as `name\0value\0` so that they can be hashed.
+#[cfg(unix)]
+fn read_xattrs(path: &Path) -> io::Result<Vec<u8>> {
+    let mut names: Vec<_> = xattr::list(path)?.collect();
+    names.sort();
+
+    let mut xattrs = Vec::new();
+    for name in names {
+        let value = xattr::get(path, &name)?.unwrap_or_default();
+        xattrs.extend_from_slice(name.to_string_lossy().as_bytes());
+        xattrs.push(0);
+        xattrs.extend_from_slice(&value);
+        xattrs.push(0);
+    }
+
+    Ok(xattrs)
+}
+
+#[cfg(not(unix))]
+fn read_xattrs(_path: &Path) -> io::Result<Vec<u8>> {
+    Ok(Vec::new())
+}
+
+/// Escape the key of an entry so that it cannot be mistaken for a header
+/// or a trailer line: a leading `#` (after any backslash) is prefixed by a backslash.
+fn escape_key(key: Cow<'_, str>) -> Cow<'_, str> {
+    if key.trim_start_matches('\\').starts_with('#') {
+        Cow::Owned(format!("\\{}", key))
+    } else {
+        key
+    }
+}
+
+/// Revert `escape_key`.
+fn unescape_key(key: &str) -> &str {
+    match key.strip_prefix('\\') {
+        Some(unescaped) if unescaped.trim_start_matches('\\').starts_with('#') => unescaped,
+        _ => key,
+    }
+}
+
+/// Verify the checksum footer of given index content (if any)
+/// and return the content without it. Index files written without
+/// a footer (by older versions, or by other tools) are returned as-is,
+/// but the footer is required as soon as a header saved along with it is found,
+/// so that a truncated index is detected.
+fn verify_checksum(content: &str) -> Result<&str, Box<dyn Error>> {
+    let trimmed = content.strip_suffix('\n').unwrap_or(content);
+    let (body, footer) = match trimmed.rfind('\n') {
+        Some(pos) => (&content[..pos + 1], &trimmed[pos + 1..]),
+        None => ("", trimmed),
+    };
+
+    let expected = match footer.strip_prefix(CHECKSUM_FOOTER) {
+        Some(expected) => expected,
+        None if content.lines().any(is_saved_header) => {
+            return Err("corrupted index file: missing checksum".into())
+        }
+        None => return Ok(content),
+    };
+
+    if hash_reader(body.as_bytes())? != expected {
+        return Err("corrupted index file: checksum mismatch".into());
+    }
+
+    Ok(body)
+}
+
+/// Returns `true` if given line is one of the headers written along with the checksum footer.
+/// The older index files may hold keys starting with `#`, which are not headers.
+fn is_saved_header(line: &str) -> bool {
+    line == SALTED_HEADER
+        || [
+            ENTRIES_HEADER,
+            BYTES_HEADER,
+            ENCODING_HEADER,
+            ALGORITHM_HEADER,
+            COMPUTED_HEADER,
+            FORMAT_HEADER,
+        ]
+        .iter()
+        .any(|header| line.starts_with(header))
+}
+
+/// Read the lines of given reader, stripping any leading BOM.
+fn read_lines<R: Read>(reader: R) -> io::Result<Vec<String>> {
+    let mut lines = Vec::new();
+    for line in BufReader::new(reader).lines() {
+        let line = line?;
+        if lines.is_empty() {
+            lines.push(line.trim_start_matches(BOM).to_string());
+        } else {
+            lines.push(line);
+        }
+    }
+
+    Ok(lines)
+}
+
+/// Allows you to access the index file directory with `[]`
+impl<'a> std::ops::Index<&'a str> for Index {
+    type Output = String;
+
+    fn index(&self, index: &'a str) -> &Self::Output {
+        &self.files[index]
+    }
+}
+
+// the number of entries listed when displaying an index
+const DISPLAYED_ENTRIES: usize = 10;
+
+/// Display the directory and the first (sorted) entries of the index, f.e for debugging.
+impl fmt::Display for Index {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(
+            f,
+            "{} ({} entries, {})",
+            self.directory.display(),
+            self.len(),
+            self.algorithm
+        )?;
+
+        let mut paths: Vec<&String> = self.files.keys().collect();
+        paths.sort();
+        for path in paths.iter().take(DISPLAYED_ENTRIES) {
+            writeln!(f, "  {}:{}", path, self.files[*path])?;
+        }
+        if paths.len() > DISPLAYED_ENTRIES {
+            writeln!(f, "  ... and {} more", paths.len() - DISPLAYED_ENTRIES)?;
+        }
+
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::{HashMap, HashSet};
+    use std::env;
+    use std::fs;
+    use std::fs::File;
+    use std::io::Write;
+    use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+    use std::sync::{Arc, Mutex};
+    use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+    use flate2::write::GzEncoder;
+    use flate2::Compression;
+    use regex::Regex;
+    use tempdir::TempDir;
+
+    use crate::backend::TEMP_INDEX_FILE;
+    use crate::index::{
+        hash_reader, AlgorithmMismatch, ComputeOptions, EmptyFiles, Hasher, Index, NdjsonEntry,
+        Normalization, SaveOptions, CHECKSUM_FOOTER, DEFAULT_ALGORITHM, EMPTY_CHECKSUM,
+        GZIPPED_IGNORE_FILE, IGNORE_FILE, INDEX_FILE, KEEP_FILE,
+    };
+
+    /// Append a valid checksum footer to given index content.
+    fn with_footer(content: &str) -> String {
+        let checksum = hash_reader(content.as_bytes()).expect("unable to hash content");
+        format!("{}{}{}\n", content, CHECKSUM_FOOTER, checksum)
+    }
+
+    #[test]
+    fn test_blank() {
+        let index = Index::blank("Tests");
+        assert_eq!(index.path().to_str().unwrap(), "Tests");
+        assert_eq!(index.len(), 0);
+        assert_eq!(index.is_empty(), true);
+    }
+
+    #[test]
+    fn test_load() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        // create dummy index
+        fs::write(
+            dir.path().join(INDEX_FILE),
+            "test:5d41402abc4b2a76b9719d911017c592",
+        )
+        .expect("unable to write index");
+
+        let index = Index::load(dir).expect("unable to load index");
+        assert_eq!(index.len(), 1);
+        assert_eq!(index["test"], "5d41402abc4b2a76b9719d911017c592");
+    }
+
+    #[test]
+    fn test_load_with_bom() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        // create dummy index starting with a BOM
+        fs::write(
+            dir.path().join(INDEX_FILE),
+            "\u{feff}test:5d41402abc4b2a76b9719d911017c592\n",
+        )
+        .expect("unable to write index");
+
+        let index = Index::load(dir).expect("unable to load index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("test"));
+        assert_eq!(index["test"], "5d41402abc4b2a76b9719d911017c592");
+    }
+
+    #[test]
+    fn test_ndjson_round_trip() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("other"), "world").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let mut buf: Vec<u8> = Vec::new();
+        index.save_ndjson(&mut buf).expect("unable to save index");
+        assert_eq!(buf.iter().filter(|&&b| b == b'\n').count(), 2);
+
+        // the entries are sorted by path
+        let paths: Vec<String> = String::from_utf8(buf.clone())
+            .expect("invalid NDJSON")
+            .lines()
+            .map(|line| {
+                let entry: NdjsonEntry = serde_json::from_str(line).expect("invalid entry");
+                entry.path
+            })
+            .collect();
+        assert_eq!(paths, ["other", "test"]);
+
+        let loaded = Index::load_ndjson(buf.as_slice(), &dir).expect("unable to load index");
+        assert_eq!(loaded.path(), index.path());
+        assert_eq!(loaded.files(), index.files());
+    }
+
+    #[test]
+    fn test_ndjson_odd_paths() {
+        let mut index = Index::blank("Tests");
+        index.files.insert(
+            "dir/a:\"quoted\" file".to_string(),
+            "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d".to_string(),
+        );
+
+        let mut buf: Vec<u8> = Vec::new();
+        index.save_ndjson(&mut buf).expect("unable to save index");
+
+        let loaded = Index::load_ndjson(buf.as_slice(), "Tests").expect("unable to load index");
+        assert_eq!(loaded.len(), 1);
+        assert_eq!(
+            loaded["dir/a:\"quoted\" file"],
+            "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+        );
+    }
+
+    #[test]
+    fn test_export_sumfile() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("sub").join("test"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("other"), "world").expect("unable to write test file");
+
+        let (mut index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.files.insert(
+            "with\nnewline".to_string(),
+            "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d".to_string(),
+        );
+
+        let mut buf: Vec<u8> = Vec::new();
+        index
+            .export_sumfile(&mut buf)
+            .expect("unable to export index");
+        assert_eq!(
+            String::from_utf8(buf).unwrap(),
+            "7c211433f02071597741e6ff5a8ea34789abbf43  other\n\
+             aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d  sub/test\n\
+             \\aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d  with\\nnewline\n"
+        );
+    }
+
+    #[test]
+    fn test_import_sumfile() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let sumfile = "7c211433f02071597741e6ff5a8ea34789abbf43  other\n\
+                       aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d *sub/binary\n\
+                       \\aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d  with\\nnewline\n";
+        let index =
+            Index::import_sumfile(sumfile.as_bytes(), &dir).expect("unable to import sumfile");
+        assert_eq!(index.len(), 3);
+        assert_eq!(index["other"], "7c211433f02071597741e6ff5a8ea34789abbf43");
+        assert_eq!(
+            index["sub/binary"],
+            "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+        );
+        assert_eq!(
+            index["with\nnewline"],
+            "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+        );
+        assert_eq!(index.algorithm(), DEFAULT_ALGORITHM);
+
+        // the export parses back
+        let mut buf: Vec<u8> = Vec::new();
+        index
+            .export_sumfile(&mut buf)
+            .expect("unable to export index");
+        let loaded = Index::import_sumfile(buf.as_slice(), &dir).expect("unable to import sumfile");
+        assert_eq!(loaded.files(), index.files());
+
+        let sumfile = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  test\n";
+        let index =
+            Index::import_sumfile(sumfile.as_bytes(), &dir).expect("unable to import sumfile");
+        assert_eq!(index.algorithm(), "sha256");
+
+        assert!(Index::import_sumfile(&b"invalid\n"[..], &dir).is_err());
+    }
+
+    #[test]
+    fn test_save_line_endings() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("a"), "hello\r\n").expect("unable to write test file");
+        fs::write(dir.path().join("sub/b"), "world").expect("unable to write test file");
+
+        let (mut index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.set_label("a", "label").expect("unable to set label");
+        index.save().expect("unable to save index");
+
+        let content = fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index");
+        assert!(!content.contains(&b'\r'));
+        assert_eq!(content.last(), Some(&b'\n'));
+    }
+
+    #[test]
+    fn test_save() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let mut index = Index::blank(dir.path());
+        for i in 0..100 {
+            index
+                .files
+                .insert(format!("dir/{}", i), format!("{:040x}", i * 31));
+        }
+        index.save().expect("unable to save index");
+
+        // build the expected content in memory
+        let mut paths: Vec<&String> = index.files.keys().collect();
+        paths.sort();
+        let mut expected = String::from("#entries:100\n#bytes:0\n");
+        for path in paths {
+            expected += format!("{}:{}\n", path, index.files[path]).as_str();
+        }
+        let checksum = hash_reader(expected.as_bytes()).expect("unable to hash content");
+        expected += format!("{}{}\n", CHECKSUM_FOOTER, checksum).as_str();
+
+        let content =
+            fs::read_to_string(dir.path().join(INDEX_FILE)).expect("unable to read index");
+        assert_eq!(content, expected);
+
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.files(), index.files());
+    }
+
+    #[test]
+    fn test_save_deterministic() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        for i in 0..50 {
+            fs::write(dir.path().join(format!("{}", i)), format!("{}", i))
+                .expect("unable to write test file");
+            fs::write(dir.path().join("sub").join(format!("{}", i)), "hello")
+                .expect("unable to write test file");
+        }
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.save().expect("unable to save index");
+        let first = fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.save().expect("unable to save index");
+        let second = fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index");
+
+        assert_eq!(first, second);
+    }
+
+    #[test]
+    fn test_load_reader() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.save().expect("unable to save index");
+        let content = fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index");
+
+        // load the index from memory for another directory
+        let target = TempDir::new("osync").expect("unable to create temp dir");
+        let loaded = Index::load_reader(content.as_slice(), &target).expect("unable to load index");
+        assert_eq!(loaded.files(), index.files());
+        assert_eq!(loaded.path(), target.path());
+
+        assert!(Index::load_reader(&b"test:invalid\n#checksum:0"[..], &target).is_err());
+    }
+
+    #[test]
+    fn test_read_summary() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        // no index yet
+        assert!(Index::read_summary(&dir)
+            .expect("unable to read summary")
+            .is_none());
+
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello world").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.total_size(), 16);
+        assert_eq!(index.metadata("b").unwrap().size, 11);
+        index.save().expect("unable to save index");
+
+        let (entries, bytes) = Index::read_summary(&dir)
+            .expect("unable to read summary")
+            .expect("missing summary");
+        assert_eq!(entries, 2);
+        assert_eq!(bytes, 16);
+
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.len(), entries);
+        assert_eq!(loaded.total_size(), bytes);
+        assert_eq!(loaded.metadata("a"), index.metadata("a"));
+    }
+
+    #[test]
+    fn test_touch() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        File::options()
+            .write(true)
+            .open(dir.path().join("test"))
+            .and_then(|f| f.set_modified(SystemTime::now() - Duration::from_secs(3600)))
+            .expect("unable to set modification time");
+
+        let (mut index, _) = Index::compute(&dir).expect("unable to compute index");
+        let previous = index.metadata("test").unwrap().clone();
+
+        // the modification time is saved with the index
+        index.save().expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.metadata("test"), Some(&previous));
+
+        let modified = SystemTime::now();
+        File::options()
+            .write(true)
+            .open(dir.path().join("test"))
+            .and_then(|f| f.set_modified(modified))
+            .expect("unable to set modification time");
+
+        index.touch("test").expect("unable to touch entry");
+        assert_eq!(index.metadata("test").unwrap().modified, Some(modified));
+        assert_ne!(index.metadata("test"), Some(&previous));
+        assert_eq!(index["test"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+
+        assert!(index.touch("missing").is_err());
+    }
+
+    #[test]
+    fn test_abs_rel_path() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let index = Index::blank(dir.path());
+        let abs = index.abs_path("sub/test");
+        assert_eq!(abs, dir.path().join("sub").join("test"));
+        assert_eq!(index.rel_path(&abs).expect("unable to get key"), "sub/test");
+
+        let outside = TempDir::new("osync").expect("unable to create temp dir");
+        assert!(index.rel_path(outside.path().join("test")).is_err());
+    }
+
+    #[test]
+    fn test_computed_at() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert!(index.computed_at().is_none());
+
+        let before = SystemTime::now();
+        let (index, _) =
+            Index::compute_with_options(&dir, &ComputeOptions::new().record_time(true))
+                .expect("unable to compute index");
+        let computed_at = index.computed_at().expect("missing computation time");
+        assert!(computed_at >= before && computed_at <= SystemTime::now());
+
+        index.save().expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        let elapsed = loaded
+            .computed_at()
+            .expect("missing computation time")
+            .duration_since(computed_at)
+            .unwrap_or_default();
+        assert!(elapsed < Duration::from_secs(1));
+    }
+
+    #[test]
+    fn test_save_cancelled() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.save().expect("unable to save index");
+        let original = fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index");
+
+        let mut index = Index::blank(dir.path());
+        for i in 0..1000 {
+            index.files.insert(
+                format!("{}", i),
+                "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d".to_string(),
+            );
+        }
+
+        // the header has already been written when the timeout is checked
+        assert!(index
+            .save_with_options(&SaveOptions::new().timeout(Duration::from_secs(0)))
+            .is_err());
+
+        let cancel = Arc::new(AtomicBool::new(true));
+        assert!(index
+            .save_with_options(&SaveOptions::new().cancel(cancel.clone()))
+            .is_err());
+
+        assert_eq!(
+            fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index"),
+            original
+        );
+        assert!(!dir.path().join(TEMP_INDEX_FILE).exists());
+
+        cancel.store(false, Ordering::SeqCst);
+        index
+            .save_with_options(&SaveOptions::new().cancel(cancel))
+            .expect("unable to save index");
+        assert_eq!(Index::load(&dir).expect("unable to load index").len(), 1000);
+    }
+
+    #[test]
+    fn test_display() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        for i in 0..12 {
+            fs::write(dir.path().join(format!("{:02}", i)), "hello")
+                .expect("unable to write test file");
+        }
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        let display = index.to_string();
+        assert!(display.starts_with(&format!("{} (12 entries, sha1)\n", dir.path().display())));
+        assert!(display.contains("  00:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d\n"));
+        assert!(display.contains("  09:"));
+        assert!(!display.contains("  10:"));
+        assert!(display.ends_with("  ... and 2 more\n"));
+    }
+
+    #[test]
+    fn test_rebase() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("sub").join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let target = TempDir::new("osync").expect("unable to create temp dir");
+        let rebased = index.rebase(&target);
+        assert_eq!(rebased.path(), target.path());
+        assert_eq!(rebased.files(), index.files());
+        assert_eq!(
+            rebased.abs_path("sub/test"),
+            target.path().join("sub").join("test")
+        );
+        assert_eq!(index.path(), dir.path());
+    }
+
+    #[test]
+    fn test_changed_since() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let now = SystemTime::now();
+        for (name, age) in &[("old", 7200), ("recent", 60), ("new", 0)] {
+            fs::write(dir.path().join(name), "hello").expect("unable to write test file");
+            File::options()
+                .write(true)
+                .open(dir.path().join(name))
+                .and_then(|f| f.set_modified(now - Duration::from_secs(*age)))
+                .expect("unable to set modification time");
+        }
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(
+            index.changed_since(now - Duration::from_secs(3600)),
+            ["new", "recent"]
+        );
+        assert_eq!(index.changed_since(now - Duration::from_secs(30)), ["new"]);
+        assert!(index.changed_since(now).is_empty());
+
+        // the modification times are unknown
+        index
+            .save_with_options(&SaveOptions::new().omit_timestamps(true))
+            .expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert!(loaded.changed_since(UNIX_EPOCH).is_empty());
+    }
+
+    #[test]
+    fn test_load_columns() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(
+            dir.path().join(INDEX_FILE),
+            "#columns:modified,checksum,owner,path,size\n\
+             1000000000:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d:root:test:5\n\
+             :7c211433f02071597741e6ff5a8ea34789abbf43:root:other\n\
+             :7c211433f02071597741e6ff5a8ea34789abbf43:root:unknown-time:5\n",
+        )
+        .expect("unable to write index");
+
+        let index = Index::load(&dir).expect("unable to load index");
+        assert_eq!(index.len(), 3);
+        assert_eq!(index["test"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+        assert_eq!(index["other"], "7c211433f02071597741e6ff5a8ea34789abbf43");
+        assert_eq!(index.metadata("test").unwrap().size, 5);
+        assert_eq!(
+            index.metadata("test").unwrap().modified,
+            Some(UNIX_EPOCH + Duration::from_secs(1))
+        );
+        assert!(index.metadata("other").is_none());
+        assert_eq!(index.metadata("unknown-time").unwrap().size, 5);
+        assert_eq!(index.metadata("unknown-time").unwrap().modified, None);
+
+        fs::write(dir.path().join(INDEX_FILE), "#columns:path,size\ntest:5\n")
+            .expect("unable to write index");
+        assert!(Index::load(&dir).is_err());
+    }
+
+    #[test]
+    fn test_save_compact() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let deep = dir
+            .path()
+            .join("some")
+            .join("deeply")
+            .join("nested")
+            .join("tree");
+        fs::create_dir_all(deep.join("sub")).expect("unable to create dir");
+        for i in 0..20 {
+            fs::write(deep.join(format!("file-{}", i)), "hello")
+                .expect("unable to write test file");
+        }
+        fs::write(deep.join("sub").join("caf\u{e9}"), "hello").expect("unable to write test file");
+        fs::write(deep.join("sub").join("caf\u{e8}"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        index.save().expect("unable to save index");
+        let size = fs::metadata(dir.path().join(INDEX_FILE)).unwrap().len();
+
+        for options in &[
+            SaveOptions::new().compact(true),
+            SaveOptions::new().compact(true).percent_encode(true),
+            SaveOptions::new().compact(true).sort_by_size(true),
+        ] {
+            index
+                .save_with_options(options)
+                .expect("unable to save index");
+            assert!(fs::metadata(dir.path().join(INDEX_FILE)).unwrap().len() < size);
+
+            let loaded = Index::load(&dir).expect("unable to load index");
+            assert_eq!(loaded.files(), index.files());
+            for path in index.files().keys() {
+                assert_eq!(loaded.metadata(path), index.metadata(path));
+            }
+        }
+    }
+
+    #[test]
+    fn test_save_sort_by_size() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), vec![0; 1024]).expect("unable to write test file");
+        fs::write(dir.path().join("c"), "hello world").expect("unable to write test file");
+        fs::write(dir.path().join("d"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index
+            .save_with_options(&SaveOptions::new().sort_by_size(true))
+            .expect("unable to save index");
+
+        let content =
+            fs::read_to_string(dir.path().join(INDEX_FILE)).expect("unable to read index");
+        let paths: Vec<&str> = content
+            .lines()
+            .filter(|line| !line.starts_with('#'))
+            .map(|line| line.split(':').next().unwrap())
+            .collect();
+        assert_eq!(paths, ["b", "c", "a", "d"]);
+
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.files(), index.files());
+    }
+
+    #[test]
+    fn test_set_label() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("generated"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("source"), "hello").expect("unable to write test file");
+
+        let (mut index, _) = Index::compute(&dir).expect("unable to compute index");
+        index
+            .set_label("generated", "generated: by build")
+            .expect("unable to set label");
+        index
+            .set_label("source", "source")
+            .expect("unable to set label");
+        assert!(index.set_label("missing", "source").is_err());
+        assert!(index.set_label("source", "multi\nline").is_err());
+
+        // the labels are saved with the index
+        index.save().expect("unable to save index");
+        let mut loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.label("generated"), Some("generated: by build"));
+        assert_eq!(loaded.label("source"), Some("source"));
+
+        loaded.set_label("source", "").expect("unable to set label");
+        assert_eq!(loaded.label("source"), None);
+
+        // but they are not part of the diff
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert!(loaded.diff_result(&current_index).is_empty());
+    }
+
+    #[test]
+    fn test_rehash() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("unchanged"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified"), "world").expect("unable to write test file");
+
+        let options = ComputeOptions::new();
+        let rehashed = index.rehash(&options).expect("unable to rehash index");
+        assert_eq!(rehashed["unchanged"], index["unchanged"]);
+        assert_eq!(
+            rehashed["modified"],
+            "7c211433f02071597741e6ff5a8ea34789abbf43"
+        );
+        assert_eq!(rehashed.metadata("modified"), index.metadata("modified"));
+        assert_eq!(rehashed.metadata("unchanged"), index.metadata("unchanged"));
+
+        // the files are hashed again the way they have been indexed
+        let options = ComputeOptions::new().path_in_digest(true);
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        fs::write(dir.path().join("modified"), "hello").expect("unable to write test file");
+
+        let rehashed = index.rehash(&options).expect("unable to rehash index");
+        assert_eq!(rehashed["unchanged"], index["unchanged"]);
+        assert_ne!(rehashed["modified"], index["modified"]);
+
+        // the checksums cannot be computed back using another algorithm
+        let mut index = index;
+        index.algorithm = "sha256".to_string();
+        assert!(index.rehash(&options).is_err());
+    }
+
+    #[test]
+    fn test_save_omit_timestamps() {
+        let mut contents = Vec::new();
+        for age in &[0, 3600] {
+            let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+            fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+            File::options()
+                .write(true)
+                .open(dir.path().join("test"))
+                .and_then(|f| f.set_modified(SystemTime::now() - Duration::from_secs(*age)))
+                .expect("unable to set modification time");
+
+            let (index, _) = Index::compute(&dir).expect("unable to compute index");
+            index
+                .save_with_options(&SaveOptions::new().omit_timestamps(true))
+                .expect("unable to save index");
+            contents.push(fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index"));
+
+            let loaded = Index::load(&dir).expect("unable to load index");
+            assert_eq!(loaded.metadata("test").unwrap().modified, None);
+        }
+
+        assert_eq!(contents[0], contents[1]);
+    }
+
+    #[test]
+    fn test_save_percent_encoded() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let paths = ["with:colon", "with space", "with\nnewline", "with%percent"];
+        let mut index = Index::blank(dir.path());
+        for path in paths.iter() {
+            index.files.insert(
+                path.to_string(),
+                "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d".to_string(),
+            );
+        }
+
+        index
+            .save_with_options(&SaveOptions::new().percent_encode(true))
+            .expect("unable to save index");
+
+        let content =
+            fs::read_to_string(dir.path().join(INDEX_FILE)).expect("unable to read index");
+        assert!(content.contains("with%3Acolon:"));
+        assert!(content.contains("with%0Anewline:"));
+
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.files(), index.files());
+    }
+
+    #[test]
+    fn test_save_leading_hash() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let mut index = Index::blank(dir.path());
+        for path in &["#entries", "#link", "#seen", "\\#escaped", "\\plain", "a#b"] {
+            index.files.insert(
+                path.to_string(),
+                "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d".to_string(),
+            );
+        }
+
+        for options in &[SaveOptions::new(), SaveOptions::new().compact(true)] {
+            index
+                .save_with_options(options)
+                .expect("unable to save index");
+            let loaded = Index::load(&dir).expect("unable to load index");
+            assert_eq!(loaded.files(), index.files());
+        }
+
+        // the colons can only be saved percent encoded
+        for path in &["#entries:x", "#link:a", "#seen:x"] {
+            index.files.insert(
+                path.to_string(),
+                "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d".to_string(),
+            );
+        }
+        index
+            .save_with_options(&SaveOptions::new().percent_encode(true))
+            .expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.files(), index.files());
+    }
+
+    #[test]
+    fn test_save_read_only() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.save().expect("unable to save index");
+        let content = fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index");
+
+        let mut index = Index::load(&dir).expect("unable to load index").read_only();
+        assert!(index.is_read_only());
+        index.remove("test").expect("unable to remove entry");
+        assert!(index.save().is_err());
+
+        let after = fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index");
+        assert_eq!(content, after);
+    }
+
+    #[test]
+    fn test_load_corrupted() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.save().expect("unable to save index");
+
+        // the saved index is valid
+        let index = Index::load(&dir).expect("unable to load index");
+        assert_eq!(index["test"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+
+        // flip a byte of the saved index
+        let mut content = fs::read(dir.path().join(INDEX_FILE)).expect("unable to read index");
+        content[0] ^= 0x01;
+        fs::write(dir.path().join(INDEX_FILE), content).expect("unable to write index");
+
+        let err = Index::load(&dir).err().expect("corruption not detected");
+        assert!(err.to_string().contains("corrupted"));
+    }
+
+    #[test]
+    fn test_load_malformed_link() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let content = with_footer("a:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d\n#link:b\n");
+        let err = Index::load_reader(content.as_bytes(), &dir)
+            .err()
+            .expect("malformed link not detected");
+        assert_eq!(err.to_string(), "corrupted index file: invalid link");
+    }
+
+    #[test]
+    fn test_load_malformed_listing_and_chunks() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        for (line, message) in &[
+            ("#listing:sub", "corrupted index file: invalid listing"),
+            ("#chunks:a", "corrupted index file: invalid chunks"),
+        ] {
+            let content = with_footer(&format!(
+                "a:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d\n{}\n",
+                line
+            ));
+            let err = Index::load_reader(content.as_bytes(), &dir)
+                .err()
+                .expect("malformed line not detected");
+            assert_eq!(err.to_string(), *message);
+        }
+    }
+
+    #[test]
+    fn test_load_malformed_seen_and_label() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        for (line, message) in &[
+            ("#seen:a", "corrupted index file: invalid first seen time"),
+            ("#label:a", "corrupted index file: invalid label"),
+        ] {
+            let content = with_footer(&format!(
+                "a:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d\n{}\n",
+                line
+            ));
+            let err = Index::load_reader(content.as_bytes(), &dir)
+                .err()
+                .expect("malformed line not detected");
+            assert_eq!(err.to_string(), *message);
+        }
+    }
+
+    #[test]
+    fn test_load_legacy_leading_hash() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        // the index files written before the checksum footer have no header,
+        // and their keys are not escaped
+        fs::write(
+            dir.path().join(INDEX_FILE),
+            "#raw:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d\n\
+             \\#escaped:7c211433f02071597741e6ff5a8ea34789abbf43\n",
+        )
+        .expect("unable to write index");
+
+        let index = Index::load(&dir).expect("unable to load index");
+        assert_eq!(index.len(), 2);
+        assert_eq!(index["#raw"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+        assert_eq!(
+            index["#escaped"],
+            "7c211433f02071597741e6ff5a8ea34789abbf43"
+        );
+    }
+
+    #[test]
+    fn test_load_truncated() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "world").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.save().expect("unable to save index");
+        let content =
+            fs::read_to_string(dir.path().join(INDEX_FILE)).expect("unable to read index");
+
+        // remove the footer and the last entry
+        let truncated = &content[..content.rfind("\nb:").unwrap() + 1];
+        fs::write(dir.path().join(INDEX_FILE), truncated).expect("unable to write index");
+        let err = Index::load(&dir).err().expect("truncation not detected");
+        assert!(err.to_string().contains("corrupted"));
+
+        // flip a byte of the footer prefix
+        let damaged = content.replace(CHECKSUM_FOOTER, "#checksun:");
+        fs::write(dir.path().join(INDEX_FILE), damaged).expect("unable to write index");
+        assert!(Index::load(&dir).is_err());
+
+        // the index files written without any header don't need a footer
+        fs::write(
+            dir.path().join(INDEX_FILE),
+            "a:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d\n",
+        )
+        .expect("unable to write index");
+        let index = Index::load(&dir).expect("unable to load index");
+        assert_eq!(index.len(), 1);
+    }
+
+    #[test]
+    fn test_load_all() {
+        let with_index = TempDir::new("osync").expect("unable to create temp dir");
+        let without_index = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(
+            with_index.path().join(INDEX_FILE),
+            "test:5d41402abc4b2a76b9719d911017c592",
+        )
+        .expect("unable to write index");
+
+        let indexes = Index::load_all(&[with_index.path(), without_index.path()])
+            .expect("unable to load indexes");
+        assert_eq!(indexes.len(), 2);
+        assert_eq!(indexes[with_index.path()].len(), 1);
+        assert!(indexes[without_index.path()].is_empty());
+    }
+
+    #[test]
+    fn test_compute_no_files() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 0);
+        assert_eq!(index.is_empty(), true);
+    }
+
+    #[test]
+    fn test_compute_with_files() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert_eq!(index.is_empty(), false);
+        assert_eq!(index["test"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+
+        // create a .osyncignore
+        fs::write(dir.path().join(IGNORE_FILE), "test\n").expect("unable to write ignore file");
+
+        // re compute index
+        let (index, ignored) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 0);
+        assert_eq!(ignored, 3); // the .osyncignore/.osync files
+    }
+
+    #[test]
+    fn test_compute_gzipped_ignore_file() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("ignored"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let mut encoder = GzEncoder::new(
+            File::create(dir.path().join(GZIPPED_IGNORE_FILE)).expect("unable to create file"),
+            Compression::default(),
+        );
+        encoder
+            .write_all(b"ignored\n")
+            .expect("unable to write ignore file");
+        encoder.finish().expect("unable to write ignore file");
+
+        let (index, ignored) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("test"));
+        assert_eq!(ignored, 4); // the .osyncignore(.gz)/.osync files
+
+        // the plain ignore file wins but the gzipped one is still not indexed
+        fs::write(dir.path().join(IGNORE_FILE), "test\n").expect("unable to write ignore file");
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("ignored"));
+    }
+
+    #[test]
+    fn test_compute_paths() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("sub").join("c"), "world").expect("unable to write test file");
+
+        let index = Index::compute_paths(&dir, &["a", "sub/c", "missing"])
+            .expect("unable to compute index");
+        let (expected, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 2);
+        assert_eq!(index["a"], expected["a"]);
+        assert_eq!(index["sub/c"], expected["sub/c"]);
+        assert!(!index.files().contains_key("b"));
+    }
+
+    #[test]
+    fn test_compute_paths_with_options() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join(IGNORE_FILE), "b").expect("unable to write ignore file");
+
+        let options = ComputeOptions::new().salt("secret");
+        let index = Index::compute_paths_with_options(&dir, &["a", "b", IGNORE_FILE], &options)
+            .expect("unable to compute index");
+        let (expected, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        // the ignored files are not indexed
+        assert_eq!(index.len(), 1);
+        assert_eq!(index["a"], expected["a"]);
+        assert!(index.is_salted());
+    }
+
+    #[test]
+    fn test_compute_file_list() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("sub").join("c"), "world").expect("unable to write test file");
+
+        let list = "./a\n\nsub/c\n";
+        let index =
+            Index::compute_file_list(list.as_bytes(), &dir).expect("unable to compute index");
+        let (expected, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 2);
+        assert_eq!(index["a"], expected["a"]);
+        assert_eq!(index["sub/c"], expected["sub/c"]);
+    }
+
+    #[test]
+    fn test_compute_from() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("sub").join("b"), "world").expect("unable to write test file");
+
+        let mut tree: HashMap<&str, &[u8]> = HashMap::new();
+        tree.insert("a", b"hello");
+        tree.insert("sub/b", b"world");
+
+        let entries = tree
+            .into_iter()
+            .map(|(path, content)| Ok((path.to_string(), content)));
+        let index = Index::compute_from(entries, &dir).expect("unable to compute index");
+        let (expected, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.files(), expected.files());
+    }
+
+    #[test]
+    fn test_compute_tar() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("sub").join("b"), "world").expect("unable to write test file");
+
+        let mut builder = tar::Builder::new(Vec::new());
+        builder
+            .append_dir_all(".", &dir)
+            .expect("unable to build archive");
+        let archive = builder.into_inner().expect("unable to build archive");
+
+        let index = Index::compute_tar(archive.as_slice(), &dir).expect("unable to compute index");
+        let (expected, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 2);
+        assert_eq!(index.files(), expected.files());
+        assert_eq!(index.metadata("sub/b").unwrap().size, 5);
+        assert!(index.diff_result(&expected).is_empty());
+    }
+
+    #[test]
+    fn test_compute_keep_markers() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let kept = dir.path().join("build").join("assets");
+        fs::create_dir_all(&kept).expect("unable to create dir");
+        fs::write(dir.path().join("build").join("out"), "hello")
+            .expect("unable to write test file");
+        fs::write(kept.join("logo"), "hello").expect("unable to write test file");
+        fs::write(kept.join(KEEP_FILE), "").expect("unable to write marker file");
+        fs::write(dir.path().join(IGNORE_FILE), "build/\n").expect("unable to write ignore file");
+
+        // the whole directory is ignored by default
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert!(index.is_empty());
+
+        let (index, _) =
+            Index::compute_with_options(&dir, &ComputeOptions::new().keep_markers(true))
+                .expect("unable to compute index");
+        let mut paths: Vec<&String> = index.files().keys().collect();
+        paths.sort();
+        assert_eq!(paths, ["build/assets/.osynckeep", "build/assets/logo"]);
+    }
+
+    #[test]
+    fn test_compute_ignore_slashes() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir_all(dir.path().join("sub").join("dir")).expect("unable to create dir");
+        fs::write(dir.path().join("sub").join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("sub").join("b"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("sub").join("dir").join("c"), "hello")
+            .expect("unable to write test file");
+
+        // a Windows-style path and a directory pattern with many trailing slashes
+        fs::write(dir.path().join(IGNORE_FILE), "sub\\a\nsub/dir//\n")
+            .expect("unable to write ignore file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        let paths: Vec<&String> = index.files().keys().collect();
+        assert_eq!(paths, ["sub/b"]);
+    }
+
+    #[test]
+    fn test_compute_with_path_mapper() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir_all(dir.path().join("src").join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("src").join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("src").join("sub").join("b"), "world")
+            .expect("unable to write test file");
+        fs::write(dir.path().join("README"), "readme").expect("unable to write test file");
+
+        // re-root everything under src/ and skip the rest
+        let (index, _) = Index::compute_with_path_mapper(&dir, |path| {
+            path.strip_prefix("src/").unwrap_or_default().to_string()
+        })
+        .expect("unable to compute index");
+
+        assert_eq!(index.len(), 2);
+        assert_eq!(index["a"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+        assert!(index.files().contains_key("sub/b"));
+        assert!(!index.files().contains_key("README"));
+    }
+
+    #[test]
+    fn test_compute_gzip() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let mut encoder = GzEncoder::new(
+            File::create(dir.path().join("test.gz")).expect("unable to create test file"),
+            Compression::default(),
+        );
+        encoder
+            .write_all(b"hello")
+            .expect("unable to write test file");
+        encoder.finish().expect("unable to write test file");
+
+        // without decompression the checksums differ
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_ne!(index["test"], index["test.gz"]);
+
+        let (index, _) = Index::compute_with_options(&dir, &ComputeOptions::new().gzip())
+            .expect("unable to compute index");
+        assert_eq!(index["test.gz"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+        assert_eq!(index["test"], index["test.gz"]);
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn test_compute_follow_links_loop() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("sub").join("test"), "hello").expect("unable to write test file");
+
+        // create a symlink pointing to its parent directory
+        std::os::unix::fs::symlink(dir.path(), dir.path().join("sub").join("loop"))
+            .expect("unable to create symlink");
+
+        let (index, _) =
+            Index::compute_with_options(&dir, &ComputeOptions::new().follow_links(true))
+                .expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert_eq!(
+            index["sub/test"],
+            "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+        );
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn test_compute_broken_links() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        std::os::unix::fs::symlink(dir.path().join("missing"), dir.path().join("dangling"))
+            .expect("unable to create symlink");
+
+        let (index, _) =
+            Index::compute_with_options(&dir, &ComputeOptions::new().follow_links(true))
+                .expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("test"));
+        assert_eq!(index.broken_links(), ["dangling"]);
+
+        // the links are not followed (nor reported) by default
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.broken_links().is_empty());
+    }
+
+    #[test]
+    fn test_compute_on_directory() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir_all(dir.path().join("a").join("b")).expect("unable to create dir");
+        fs::create_dir(dir.path().join("c")).expect("unable to create dir");
+        fs::write(dir.path().join("a").join("test"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("a").join("b").join("test"), "hello")
+            .expect("unable to write test file");
+
+        let directories = Arc::new(Mutex::new(Vec::new()));
+        let visited = directories.clone();
+        let options = ComputeOptions::new().on_directory(move |path, children| {
+            visited.lock().unwrap().push((path.to_string(), children));
+        });
+        Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        let mut directories = directories.lock().unwrap().clone();
+        directories.sort();
+        assert_eq!(
+            directories,
+            [
+                ("".to_string(), 2),
+                ("a".to_string(), 2),
+                ("a/b".to_string(), 1),
+                ("c".to_string(), 0)
+            ]
+        );
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn test_compute_logger() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        std::os::unix::fs::symlink(dir.path().join("missing"), dir.path().join("dangling"))
+            .expect("unable to create symlink");
+
+        let messages = Arc::new(Mutex::new(Vec::new()));
+        let logged = messages.clone();
+        let options = ComputeOptions::new()
+            .follow_links(true)
+            .logger(move |message| logged.lock().unwrap().push(message.to_string()));
+        Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(
+            *messages.lock().unwrap(),
+            ["skipping broken link: dangling"]
+        );
+    }
+
+    #[test]
+    fn test_compute_matcher() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("sub").join("test.log"), "hello")
+            .expect("unable to write test file");
+        fs::write(dir.path().join("test.log"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join(IGNORE_FILE), "test\n").expect("unable to write ignore file");
+
+        let options = ComputeOptions::new().matcher(|path: &str| path.ends_with(".log"));
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("test"));
+    }
+
+    #[test]
+    fn test_compute_ignored_directory() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let deep = dir.path().join("src").join("node_modules").join("lib");
+        fs::create_dir_all(&deep).expect("unable to create dir");
+        fs::write(deep.join("index.js"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("src").join("main.js"), "hello")
+            .expect("unable to write test file");
+        fs::write(dir.path().join(IGNORE_FILE), "node_modules/\n")
+            .expect("unable to write ignore file");
+
+        let reads = Arc::new(AtomicUsize::new(0));
+        let options = ComputeOptions::new().count_reads(&reads);
+
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("src/main.js"));
+        assert_eq!(reads.load(Ordering::SeqCst), 1);
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn test_compute_canonical_paths() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("real")).expect("unable to create dir");
+        fs::write(dir.path().join("real").join("test"), "hello")
+            .expect("unable to write test file");
+        std::os::unix::fs::symlink(dir.path().join("real"), dir.path().join("link"))
+            .expect("unable to create symlink");
+
+        // following the links index the file twice
+        let (index, _) =
+            Index::compute_with_options(&dir, &ComputeOptions::new().follow_links(true))
+                .expect("unable to compute index");
+        assert_eq!(index.len(), 2);
+
+        let (index, _) =
+            Index::compute_with_options(&dir, &ComputeOptions::new().canonical_paths(true))
+                .expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("real/test"));
+        assert!(index.conflicts().is_empty());
+    }
+
+    #[test]
+    fn test_compute_real_root() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let root = dir.path().join(".").join("sub").join("..");
+        let (index, _) = Index::compute_with_options(&root, &ComputeOptions::new().real_root(true))
+            .expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("test"));
+        assert_eq!(
+            index.path(),
+            fs::canonicalize(&dir).expect("unable to resolve dir")
+        );
+    }
+
+    #[test]
+    fn test_compute_cdc() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        // generate some pseudo-random content
+        let mut state: u32 = 42;
+        let content: Vec<u8> = (0..64 * 1024)
+            .map(|_| {
+                state = state.wrapping_mul(1_103_515_245).wrapping_add(12345);
+                (state >> 16) as u8
+            })
+            .collect();
+        fs::write(dir.path().join("test"), &content).expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute_cdc(&dir, 1024).expect("unable to compute index");
+        let previous_chunks = previous_index.chunks("test").expect("missing chunks");
+        assert!(previous_chunks.len() > 16);
+
+        // the chunks are saved with the index
+        previous_index.save().expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.chunks("test"), Some(previous_chunks));
+
+        // insert some bytes at the start of the file
+        let mut modified = b"some inserted bytes".to_vec();
+        modified.extend_from_slice(&content);
+        fs::write(dir.path().join("test"), &modified).expect("unable to write test file");
+
+        let (current_index, _) = Index::compute_cdc(&dir, 1024).expect("unable to compute index");
+        let current_chunks = current_index.chunks("test").expect("missing chunks");
+        let unchanged = previous_chunks
+            .iter()
+            .filter(|c| current_chunks.contains(c))
+            .count();
+        assert!(unchanged >= previous_chunks.len() - 2);
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert!(index.chunks("test").is_none());
+    }
+
+    #[test]
+    fn test_compute_incremental() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("unchanged.txt"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("modified.txt"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted.txt"), "hello").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("modified.txt"), "hello world")
+            .expect("unable to write test file");
+        fs::remove_file(dir.path().join("deleted.txt")).expect("unable to remove test file");
+        fs::write(dir.path().join("added.txt"), "world").expect("unable to write test file");
+
+        let reads = Arc::new(AtomicUsize::new(0));
+        let options = ComputeOptions::new().count_reads(&reads);
+
+        let (index, _) = Index::compute_incremental_with_options(&dir, &previous_index, &options)
+            .expect("unable to compute index");
+        assert_eq!(reads.load(Ordering::SeqCst), 2);
+        assert_eq!(index.len(), 3);
+        assert_eq!(index["unchanged.txt"], previous_index["unchanged.txt"]);
+        assert_ne!(index["modified.txt"], previous_index["modified.txt"]);
+        assert!(index.files().contains_key("added.txt"));
+        assert!(!index.files().contains_key("deleted.txt"));
+
+        // the result is the same as a full computation
+        let (expected, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.files(), expected.files());
+    }
+
+    #[test]
+    fn test_compute_cwd_relative() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("sub").join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) =
+            Index::compute_with_options(&dir, &ComputeOptions::new().cwd_relative(true))
+                .expect("unable to compute index");
+
+        assert_eq!(index.len(), 1);
+        // the temporary directory is outside of the current directory
+        let key = index.files().keys().next().unwrap();
+        assert!(key.starts_with("../"));
+        assert!(key.ends_with("/sub/test"));
+
+        // the key resolves to the file from the current directory
+        let cwd = env::current_dir().expect("unable to get current directory");
+        assert_eq!(
+            fs::canonicalize(cwd.join(key)).expect("unable to resolve key"),
+            fs::canonicalize(dir.path().join("sub").join("test")).expect("unable to resolve path")
+        );
+    }
+
+    #[test]
+    fn test_compute_empty_files() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("empty.txt"), "").expect("unable to write test file");
+        fs::write(dir.path().join("test.txt"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(
+            index["empty.txt"],
+            "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+        );
+
+        let options = ComputeOptions::new().empty_files(EmptyFiles::Skip);
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("test.txt"));
+
+        let reads = Arc::new(AtomicUsize::new(0));
+        let options = ComputeOptions::new()
+            .empty_files(EmptyFiles::Sentinel)
+            .count_reads(&reads);
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(index.len(), 2);
+        assert_eq!(index["empty.txt"], EMPTY_CHECKSUM);
+        assert_eq!(reads.load(Ordering::SeqCst), 1);
+        assert!(index.verify().is_ok());
+    }
+
+    #[test]
+    fn test_prune_empty() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+        fs::create_dir_all(dir.path().join("a").join("empty")).expect("unable to create dir");
+        fs::create_dir(dir.path().join("empty")).expect("unable to create dir");
+        fs::write(dir.path().join("a").join("test"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("empty_file"), "").expect("unable to write test file");
+
+        let options = ComputeOptions::new()
+            .empty_directories(true)
+            .empty_files(EmptyFiles::Sentinel);
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(index.empty_directories(), ["a/empty", "empty"]);
+        assert_eq!(index.len(), 2);
+
+        // the empty directories are saved along with the entries
+        index.save().expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.empty_directories(), index.empty_directories());
+
+        let pruned = index.prune_empty();
+        assert!(pruned.empty_directories().is_empty());
+        assert_eq!(pruned.files(), index.files());
+
+        // the index itself is left untouched
+        assert_eq!(index.empty_directories().len(), 2);
+    }
+
+    #[test]
+    fn test_compute_empty_directories_ignored_children() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+        fs::create_dir(dir.path().join("logs")).expect("unable to create dir");
+        fs::create_dir_all(dir.path().join("build").join("empty")).expect("unable to create dir");
+        fs::write(dir.path().join("logs").join("debug.log"), "hello")
+            .expect("unable to write test file");
+        fs::write(dir.path().join(IGNORE_FILE), "logs/debug.log\nbuild/\n")
+            .expect("unable to write ignore file");
+
+        // the directories holding only ignored files are empty,
+        // and the ignored directories are not walked
+        for keep_markers in &[false, true] {
+            let options = ComputeOptions::new()
+                .empty_directories(true)
+                .keep_markers(*keep_markers);
+            let (index, _) =
+                Index::compute_with_options(&dir, &options).expect("unable to compute index");
+            assert_eq!(index.empty_directories(), ["logs"]);
+            assert!(index.is_empty());
+        }
+    }
+
+    #[test]
+    fn test_compute_with_magic() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let png: &[u8] = b"\x89PNG\r\n\x1a\n";
+        let jpeg: &[u8] = b"\xff\xd8\xff";
+        let mut image = png.to_vec();
+        image.extend_from_slice(b"image data");
+        fs::write(dir.path().join("image.png"), &image).expect("unable to write test file");
+        fs::write(dir.path().join("short"), &png[..4]).expect("unable to write test file");
+        fs::write(dir.path().join("test.txt"), "hello").expect("unable to write test file");
+
+        let (index, _) =
+            Index::compute_with_magic(&dir, &[jpeg, png]).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("image.png"));
+    }
+
+    #[test]
+    fn test_compute_exclude_newest() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let now = SystemTime::now();
+        for (name, age) in &[("a", 300), ("b", 0), ("c", 600), ("d", 100)] {
+            fs::write(dir.path().join(name), "hello").expect("unable to write test file");
+            File::options()
+                .write(true)
+                .open(dir.path().join(name))
+                .and_then(|f| f.set_modified(now - Duration::from_secs(*age)))
+                .expect("unable to set modification time");
+        }
+
+        let (index, _) = Index::compute_exclude_newest(&dir, 2).expect("unable to compute index");
+        let mut paths: Vec<&String> = index.files().keys().collect();
+        paths.sort();
+        assert_eq!(paths, ["a", "c"]);
+
+        let (index, _) = Index::compute_exclude_newest(&dir, 0).expect("unable to compute index");
+        assert_eq!(index.len(), 4);
+
+        // the directory is walked twice but only reported once
+        let directories = Arc::new(Mutex::new(Vec::new()));
+        let visited = directories.clone();
+        let options = ComputeOptions::new()
+            .exclude_newest(2)
+            .on_directory(move |path, _| visited.lock().unwrap().push(path.to_string()));
+        Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(*directories.lock().unwrap(), [""]);
+    }
+
+    #[test]
+    fn test_compute_first_seen() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("old"), "hello").expect("unable to write test file");
+
+        let options = ComputeOptions::new().first_seen(true);
+        let (previous_index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        let old_seen = previous_index
+            .first_seen("old")
+            .expect("missing first seen time");
+
+        // the first seen times are saved with the index
+        previous_index.save().expect("unable to save index");
+        let previous_index = Index::load(&dir).expect("unable to load index");
+        assert_eq!(previous_index.first_seen("old"), Some(old_seen));
+
+        let start = SystemTime::now();
+        fs::write(dir.path().join("old"), "hello world").expect("unable to write test file");
+        fs::write(dir.path().join("new"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute_incremental_with_options(&dir, &previous_index, &options)
+            .expect("unable to compute index");
+        assert_eq!(index.first_seen("old"), Some(old_seen));
+        assert!(index.first_seen("new").expect("missing first seen time") >= start);
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert!(index.first_seen("old").is_none());
+    }
+
+    #[test]
+    fn test_compute_directory_listings() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir_all(dir.path().join("a").join("b")).expect("unable to create dir");
+        fs::create_dir(dir.path().join("c")).expect("unable to create dir");
+        fs::write(dir.path().join("a").join("b").join("test"), "hello")
+            .expect("unable to write test file");
+        fs::write(dir.path().join("c").join("test"), "hello").expect("unable to write test file");
+
+        let options = ComputeOptions::new().directory_listings(true);
+        let (previous_index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert!(previous_index.listing("").is_some());
+        assert!(previous_index.listing("a").is_some());
+        assert!(previous_index.listing("a/b").is_some());
+        assert!(previous_index.listing("test").is_none());
+
+        // the listings are saved with the index
+        previous_index.save().expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.listing("a/b"), previous_index.listing("a/b"));
+
+        // modifying a file does not change the listing
+        fs::write(dir.path().join("c").join("test"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("a").join("b").join("added"), "hello")
+            .expect("unable to write test file");
+
+        let (current_index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_ne!(current_index.listing("a/b"), previous_index.listing("a/b"));
+        assert_eq!(current_index.listing("a"), previous_index.listing("a"));
+        assert_eq!(current_index.listing("c"), previous_index.listing("c"));
+        assert_eq!(current_index.listing(""), previous_index.listing(""));
+    }
+
+    #[test]
+    fn test_compute_buffer_size() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), vec![42; 100_000]).expect("unable to write test file");
+
+        let (expected, _) = Index::compute(&dir).expect("unable to compute index");
+        for buffer_size in &[1, 1000, 65536, 1 << 20] {
+            let options = ComputeOptions::new().buffer_size(*buffer_size);
+            let (index, _) =
+                Index::compute_with_options(&dir, &options).expect("unable to compute index");
+            assert_eq!(index.files(), expected.files());
+        }
+    }
+
+    #[test]
+    fn test_compute_rate_limit() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), vec![0; 4096]).expect("unable to write test file");
+
+        let start = Instant::now();
+        let (index, _) = Index::compute_with_options(&dir, &ComputeOptions::new().rate_limit(8192))
+            .expect("unable to compute index");
+        assert!(start.elapsed() >= Duration::from_millis(500));
+
+        let (expected, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.files(), expected.files());
+    }
+
+    #[test]
+    fn test_compute_grace_period() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("old"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("recent"), "hello").expect("unable to write test file");
+
+        File::options()
+            .write(true)
+            .open(dir.path().join("old"))
+            .and_then(|f| f.set_modified(SystemTime::now() - Duration::from_secs(3600)))
+            .expect("unable to set modification time");
+
+        let options = ComputeOptions::new().grace_period(Duration::from_secs(60));
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("old"));
+    }
+
+    #[test]
+    fn test_compute_gitignore() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir_all(dir.path().join("build").join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("build").join("out"), "hello")
+            .expect("unable to write test file");
+        fs::write(dir.path().join("build").join("sub").join("out"), "hello")
+            .expect("unable to write test file");
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join(".gitignore"), "build/\n").expect("unable to write gitignore");
+
+        // .gitignore files are not honored by default
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.len(), 4);
+
+        let (index, _) = Index::compute_with_options(&dir, &ComputeOptions::new().gitignore(true))
+            .expect("unable to compute index");
+        assert_eq!(index.len(), 2);
+        assert!(index.files().contains_key("test"));
+        assert!(index.files().contains_key(".gitignore"));
+    }
+
+    #[test]
+    fn test_compute_with_hasher() {
+        struct Sha256(sha2::Sha256);
+
+        impl Hasher for Sha256 {
+            fn update(&mut self, data: &[u8]) {
+                sha2::Digest::update(&mut self.0, data);
+            }
+
+            fn finalize(self: Box<Self>) -> Vec<u8> {
+                sha2::Digest::finalize(self.0).to_vec()
+            }
+        }
+
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index.algorithm(), DEFAULT_ALGORITHM);
+
+        let (index, _) =
+            Index::compute_with_hasher(&dir, "sha256", || Box::new(Sha256(sha2::Digest::new())))
+                .expect("unable to compute index");
+        assert_eq!(index.algorithm(), "sha256");
+        assert_eq!(
+            index["test"],
+            "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+        );
+
+        // the label is saved with the index
+        index.save().expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.algorithm(), "sha256");
+        assert_eq!(loaded.files(), index.files());
+    }
+
+    #[test]
+    fn test_compute_with_regex_excludes() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::create_dir(dir.path().join("tmp")).expect("unable to create dir");
+        fs::write(dir.path().join("tmp").join("a.bak"), "hello")
+            .expect("unable to write test file");
+        fs::write(dir.path().join("tmp").join("b"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("c.bak"), "hello").expect("unable to write test file");
+
+        let patterns = [Regex::new(r"^tmp/.*\.bak$").unwrap()];
+        let (index, _) =
+            Index::compute_with_regex_excludes(&dir, &patterns).expect("unable to compute index");
+        let mut paths: Vec<&String> = index.files().keys().collect();
+        paths.sort();
+        assert_eq!(paths, ["c.bak", "tmp/b"]);
+    }
+
+    #[test]
+    fn test_compute_salt() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        let options = ComputeOptions::new().salt("secret");
+        let (salted, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        let options = ComputeOptions::new().salt("other secret");
+        let (other, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        assert!(!index.is_salted());
+        assert!(salted.is_salted());
+        assert_ne!(salted["test"], index["test"]);
+        assert_ne!(salted["test"], other["test"]);
+        assert!(!salted.verify().is_ok());
+
+        // the chunks are salted too
+        let (chunked, _) = Index::compute_cdc(&dir, 1024).expect("unable to compute index");
+        let options = ComputeOptions::new().chunking(1024).salt("secret");
+        let (salted_chunks, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(
+            chunked.chunks("test"),
+            Some(&[index["test"].to_string()][..])
+        );
+        assert_ne!(salted_chunks.chunks("test"), chunked.chunks("test"));
+
+        // only the flag is saved, not the secret
+        salted.save().expect("unable to save index");
+        let content =
+            fs::read_to_string(dir.path().join(INDEX_FILE)).expect("unable to read index");
+        assert!(content.contains("#salted\n"));
+        assert!(!content.contains("secret"));
+
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert!(loaded.is_salted());
+        assert_eq!(loaded["test"], salted["test"]);
+
+        let (pruned, _) = loaded.prune().expect("unable to prune index");
+        assert!(pruned.is_salted());
+    }
+
+    #[test]
+    fn test_compute_with_path_in_digest() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        // if there's no .osync file in the directory, return
-        // new blank index
-        if !index_path.exists() {
-            return Ok(Index::blank(directory));
-        }
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello").expect("unable to write test file");
 
-        // otherwise read index file line by line
-        let mut files: HashMap<String, String> = HashMap::new();
-        let buf = BufReader::new(File::open(index_path)?);
-        for line in buf.lines() {
-            let line = line.unwrap();
-            let parts: Vec<&str> = line.split(':').collect();
-            files.insert(parts[0].to_string(), parts[1].to_string());
-        }
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(index["a"], index["b"]);
 
-        Ok(Index {
-            directory: directory.as_ref().to_path_buf(),
-            files,
-        })
+        let (index, _) = Index::compute_with_path_in_digest(&dir).expect("unable to compute index");
+        assert_ne!(index["a"], index["b"]);
+        assert_ne!(index["a"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
     }
 
-    /// Compute the index for given directory.
-    pub fn compute<P: AsRef<Path>>(directory: P) -> Result<(Index, usize), Box<dyn Error>> {
-        // try to load .osyncignore file
-        let mut ignored_files: HashMap<String, bool> = HashMap::new();
-        if let Ok(file) = File::open(directory.as_ref().join(IGNORE_FILE)) {
-            let buf = BufReader::new(file);
-            for line in buf.lines() {
-                ignored_files.insert(line.unwrap(), true);
-            }
-        }
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn test_compute_xattrs() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        // do not upload .osync(ignore) files
-        ignored_files.insert(INDEX_FILE.to_string(), true);
-        ignored_files.insert(IGNORE_FILE.to_string(), true);
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
 
-        let mut files: HashMap<String, String> = HashMap::new();
-        for entry in WalkDir::new(&directory).into_iter().filter_map(|e| e.ok()) {
-            let local_path = entry.path().strip_prefix(&directory)?;
-            let metadata = entry.metadata().unwrap();
+        let options = ComputeOptions::new().xattrs(true);
+        let (previous_index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(
+            previous_index["test"],
+            "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+        );
 
-            if metadata.is_file() && !ignored_files.contains_key(local_path.to_str().unwrap()) {
-                let bytes = fs::read(entry.path()).expect("unable to read file");
+        xattr::set(dir.path().join("test"), "user.osync", b"test").expect("unable to set xattr");
 
-                let mut hasher = sha1::Sha1::new();
-                hasher.update(bytes);
+        let (current_index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        let (changed_files, deleted_files) = previous_index.diff(&current_index);
+        assert_eq!(changed_files, vec!["test"]);
+        assert!(deleted_files.is_empty());
+    }
 
-                files.insert(
-                    local_path.to_str().unwrap().to_string(),
-                    format!("{:x}", hasher.finalize()),
-                );
-            }
-        }
+    #[test]
+    fn test_paths_with_checksum() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        Ok((
-            Index {
-                directory: directory.as_ref().to_path_buf(),
-                files,
-            },
-            ignored_files.len(),
-        ))
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("c"), "world").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(
+            index.paths_with_checksum("aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"),
+            vec!["a", "b"]
+        );
+        assert!(index.paths_with_checksum("unknown").is_empty());
     }
 
-    /// Save the index to the disk.
-    pub fn save(&self) -> Result<(), Box<dyn Error>> {
-        let mut file = File::create(self.directory.join(INDEX_FILE))?;
+    #[test]
+    fn test_compute_normalization() {
+        let nfc_dir = TempDir::new("osync").expect("unable to create temp dir");
+        let nfd_dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        // create file content
-        let mut content = String::new();
-        for (path, hash) in self.files.iter() {
-            content += format!("{}:{}\n", path, hash).as_str();
-        }
+        fs::write(nfc_dir.path().join("caf\u{e9}"), "hello").expect("unable to write test file");
+        fs::write(nfd_dir.path().join("cafe\u{301}"), "hello").expect("unable to write test file");
 
-        file.write_all(content.as_bytes()).map_err(|e| e.into())
+        // without normalization the keys differ
+        let (nfc_index, _) = Index::compute(&nfc_dir).expect("unable to compute index");
+        let (nfd_index, _) = Index::compute(&nfd_dir).expect("unable to compute index");
+        assert_ne!(nfc_index.files(), nfd_index.files());
+
+        let options = ComputeOptions::new().normalization(Normalization::Nfc);
+        let (nfc_index, _) =
+            Index::compute_with_options(&nfc_dir, &options).expect("unable to compute index");
+        let (nfd_index, _) =
+            Index::compute_with_options(&nfd_dir, &options).expect("unable to compute index");
+        assert!(nfd_index.files().contains_key("caf\u{e9}"));
+        assert_eq!(nfc_index.files(), nfd_index.files());
     }
 
-    /// Compute the difference between the indexes self & b
-    /// return the changed files (new, modified) and the deleted.
-    pub fn diff(&self, b: &Index) -> (Vec<String>, Vec<String>) {
-        let mut changed_files: Vec<String> = Vec::new();
-        let mut deleted_files: Vec<String> = Vec::new();
+    #[test]
+    fn test_compute_stream() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        for (path, hash) in &b.files {
-            if self.files.get(path).is_none() || self.files.get(path).unwrap() != hash {
-                changed_files.push(path.to_string());
-            }
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        for i in 0..10 {
+            fs::write(dir.path().join(format!("{}", i)), format!("{}", i))
+                .expect("unable to write test file");
+            fs::write(dir.path().join("sub").join(format!("{}", i)), "hello")
+                .expect("unable to write test file");
         }
 
-        for path in self.files.keys() {
-            if !b.files.contains_key(path) {
-                deleted_files.push(path.to_string());
-            }
+        let mut files: HashMap<String, String> = HashMap::new();
+        for entry in Index::compute_stream(&dir) {
+            let entry = entry.expect("unable to compute entry");
+            files.insert(entry.path, entry.checksum);
         }
 
-        (changed_files, deleted_files)
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(files.len(), 20);
+        assert_eq!(&files, index.files());
     }
 
-    /// Returns the number of files in the index.
-    pub fn len(&self) -> usize {
-        self.files.len()
-    }
+    #[test]
+    fn test_estimate_compute() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-    /// Returns `true` if the index contains no files.
-    pub fn is_empty(&self) -> bool {
-        self.files.is_empty()
-    }
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("sub").join("test"), "world!")
+            .expect("unable to write test file");
+        fs::write(dir.path().join("ignored"), "ignored").expect("unable to write test file");
+        fs::write(dir.path().join(IGNORE_FILE), "ignored\n").expect("unable to write ignore file");
 
-    /// Returns the path which the index is computed for.
-    pub fn path(&self) -> PathBuf {
-        self.directory.clone()
-    }
+        let (files, bytes) = Index::estimate_compute(&dir).expect("unable to estimate compute");
+        assert_eq!(files, 2);
+        assert_eq!(bytes, 11);
 
-    pub fn files(&self) -> &HashMap<String, String> {
-        &self.files
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        assert_eq!(files, index.len());
     }
 
-    pub fn update(&mut self, path: &str) -> Result<(), Box<dyn Error>> {
-        let bytes = fs::read(self.directory.join(path))?;
+    #[test]
+    #[cfg(unix)]
+    fn test_compute_exclude_inodes() {
+        use std::os::unix::fs::MetadataExt;
 
-        let mut hasher = sha1::Sha1::new();
-        hasher.update(bytes);
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        self.files
-            .insert(path.to_string(), format!("{:x}", hasher.finalize()));
-        Ok(())
-    }
+        fs::write(dir.path().join("excluded"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
 
-    pub fn remove(&mut self, path: &str) -> Result<(), Box<dyn Error>> {
-        self.files.remove(path);
-        Ok(())
+        let mut inodes = HashSet::new();
+        inodes.insert(
+            fs::metadata(dir.path().join("excluded"))
+                .expect("unable to read metadata")
+                .ino(),
+        );
+
+        let (index, _) =
+            Index::compute_exclude_inodes(&dir, &inodes).expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("test"));
     }
-}
 
-/// Allows you to access the index file directory with `[]`
-impl<'a> std::ops::Index<&'a str> for Index {
-    type Output = String;
+    #[test]
+    #[cfg(unix)]
+    fn test_compute_owner() {
+        use std::os::unix::fs::MetadataExt;
 
-    fn index(&self, index: &'a str) -> &Self::Output {
-        &self.files[index]
-    }
-}
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-#[cfg(test)]
-mod tests {
-    use std::fs;
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        let uid = fs::metadata(dir.path().join("test"))
+            .expect("unable to read metadata")
+            .uid();
 
-    use tempdir::TempDir;
+        // the file has been created by the current user
+        let (index, _) = Index::compute_with_options(&dir, &ComputeOptions::new().owned_only())
+            .expect("unable to compute index");
+        assert_eq!(index.len(), 1);
+        assert!(index.files().contains_key("test"));
 
-    use crate::index::{Index, IGNORE_FILE, INDEX_FILE};
+        // the file is not owned by this user
+        let (index, _) = Index::compute_with_options(&dir, &ComputeOptions::new().owner(uid + 1))
+            .expect("unable to compute index");
+        assert!(index.is_empty());
+    }
 
     #[test]
-    fn test_blank() {
-        let index = Index::blank("Tests");
-        assert_eq!(index.path().to_str().unwrap(), "Tests");
-        assert_eq!(index.len(), 0);
-        assert_eq!(index.is_empty(), true);
+    #[cfg(unix)]
+    fn test_compute_hard_links() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("a.txt"), "hello").expect("unable to write test file");
+        fs::hard_link(dir.path().join("a.txt"), dir.path().join("b.txt"))
+            .expect("unable to create hard link");
+
+        let reads = Arc::new(AtomicUsize::new(0));
+        let options = ComputeOptions::new().hard_links(true).count_reads(&reads);
+
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(reads.load(Ordering::SeqCst), 1);
+        assert_eq!(index.len(), 1);
+        assert_eq!(index.links().len(), 1);
+
+        let (path, target) = index.links().iter().next().unwrap();
+        assert_ne!(path, target);
+        assert_eq!(index[target], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+
+        // links are saved with the index
+        index.save().expect("unable to save index");
+        let loaded = Index::load(&dir).expect("unable to load index");
+        assert_eq!(loaded.files(), index.files());
+        assert_eq!(loaded.links(), index.links());
     }
 
     #[test]
-    fn test_load() {
+    #[cfg(unix)]
+    fn test_compute_inode_cache() {
         let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        // create dummy index
-        fs::write(
-            dir.path().join(INDEX_FILE),
-            "test:5d41402abc4b2a76b9719d911017c592",
-        )
-        .expect("unable to write index");
+        fs::write(dir.path().join("a.txt"), "hello").expect("unable to write test file");
+        fs::hard_link(dir.path().join("a.txt"), dir.path().join("b.txt"))
+            .expect("unable to create hard link");
 
-        let index = Index::load(dir).expect("unable to load index");
-        assert_eq!(index.len(), 1);
-        assert_eq!(index["test"], "5d41402abc4b2a76b9719d911017c592");
+        let reads = Arc::new(AtomicUsize::new(0));
+        let options = ComputeOptions::new().inode_cache(true).count_reads(&reads);
+
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(reads.load(Ordering::SeqCst), 1);
+        assert_eq!(index.len(), 2);
+        assert!(index.links().is_empty());
+        assert_eq!(index["a.txt"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+        assert_eq!(index["b.txt"], index["a.txt"]);
     }
 
     #[test]
-    fn test_compute_no_files() {
+    fn test_prune() {
         let dir = TempDir::new("osync").expect("unable to create temp dir");
 
+        fs::write(dir.path().join("kept"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted"), "hello").expect("unable to write test file");
+
         let (index, _) = Index::compute(&dir).expect("unable to compute index");
-        assert_eq!(index.len(), 0);
-        assert_eq!(index.is_empty(), true);
+        assert_eq!(index.len(), 2);
+
+        fs::remove_file(dir.path().join("deleted")).expect("unable to remove test file");
+
+        let (pruned_index, pruned) = index.prune().expect("unable to prune index");
+        assert_eq!(pruned, vec!["deleted"]);
+        assert_eq!(pruned_index.len(), 1);
+        assert_eq!(pruned_index["kept"], index["kept"]);
+        assert_eq!(pruned_index.path(), index.path());
     }
 
     #[test]
-    fn test_compute_with_files() {
+    fn test_update() {
         let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello").expect("unable to write test file");
 
-        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        let (mut index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("a"), "world").expect("unable to write test file");
+        index.update("a").expect("unable to update index");
+        assert_eq!(index["a"], "7c211433f02071597741e6ff5a8ea34789abbf43");
+        assert_eq!(index["b"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+
+        // the entry is removed when the file is gone
+        fs::remove_file(dir.path().join("a")).expect("unable to remove test file");
+        index.update("a").expect("unable to update index");
+        assert!(!index.files().contains_key("a"));
         assert_eq!(index.len(), 1);
-        assert_eq!(index.is_empty(), false);
-        assert_eq!(index["test"], "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d");
+    }
 
-        // create a .osyncignore
-        fs::write(dir.path().join(IGNORE_FILE), "test\n").expect("unable to write ignore file");
+    #[test]
+    fn test_update_with_options() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
 
-        // re compute index
-        let (index, ignored) = Index::compute(&dir).expect("unable to compute index");
-        assert_eq!(index.len(), 0);
-        assert_eq!(ignored, 3); // the .osyncignore/.osync files
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello").expect("unable to write test file");
+
+        let options = ComputeOptions::new()
+            .path_in_digest(true)
+            .empty_files(EmptyFiles::Sentinel);
+        let (mut index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        // the updated entries match a full compute
+        fs::write(dir.path().join("a"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "").expect("unable to write test file");
+        index
+            .update_with_options("a", &options)
+            .expect("unable to update index");
+        index
+            .update_with_options("b", &options)
+            .expect("unable to update index");
+
+        let (expected, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert_eq!(index.files(), expected.files());
+        assert_eq!(index["b"], EMPTY_CHECKSUM);
+
+        // the checksums of a salted index cannot be computed without the salt
+        let options = ComputeOptions::new().salt("secret");
+        let (mut index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        assert!(index.update("a").is_err());
+        index
+            .update_with_options("a", &options)
+            .expect("unable to update index");
     }
 
     #[test]
@@ -252,4 +5361,267 @@ mod tests {
         assert_eq!(changed_files.len(), 0);
         assert!(deleted_files.is_empty());
     }
+
+    #[test]
+    fn test_quick_diff_directory() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("grown"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("same_size"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("deleted"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        // the size change is enough to flag the file
+        let modified = index.metadata("grown").unwrap().modified.unwrap();
+        fs::write(dir.path().join("grown"), "hello world").expect("unable to write test file");
+        File::options()
+            .write(true)
+            .open(dir.path().join("grown"))
+            .and_then(|f| f.set_modified(modified))
+            .expect("unable to set modification time");
+
+        // the content is not read so the change is not detected
+        let modified = index.metadata("same_size").unwrap().modified.unwrap();
+        fs::write(dir.path().join("same_size"), "world").expect("unable to write test file");
+        File::options()
+            .write(true)
+            .open(dir.path().join("same_size"))
+            .and_then(|f| f.set_modified(modified))
+            .expect("unable to set modification time");
+
+        fs::remove_file(dir.path().join("deleted")).expect("unable to remove test file");
+        fs::write(dir.path().join("added"), "hello").expect("unable to write test file");
+
+        let (mut changed_files, deleted_files) = index
+            .quick_diff_directory()
+            .expect("unable to diff directory");
+        changed_files.sort();
+        assert_eq!(changed_files, vec!["added", "grown"]);
+        assert_eq!(deleted_files, vec!["deleted"]);
+    }
+
+    #[test]
+    fn test_diff_expect() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("expected"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("unexpected"), "hello").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::remove_file(dir.path().join("expected")).expect("unable to remove test file");
+        fs::remove_file(dir.path().join("unexpected")).expect("unable to remove test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let mut expected_deletions = HashSet::new();
+        expected_deletions.insert("expected".to_string());
+
+        let (changed_files, deleted_files) =
+            previous_index.diff_expect(&current_index, &expected_deletions);
+        assert!(changed_files.is_empty());
+        assert_eq!(deleted_files, vec!["unexpected"]);
+    }
+
+    #[test]
+    fn test_diff_by_size_change() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("small"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("large"), "hello").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("small"), "hello!").expect("unable to write test file");
+        fs::write(dir.path().join("large"), vec![0; 1024 * 1024])
+            .expect("unable to write test file");
+
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        assert_eq!(
+            previous_index.diff_by_size_change(&current_index, 1024),
+            vec!["large"]
+        );
+        assert_eq!(
+            previous_index.diff_by_size_change(&current_index, 0),
+            vec!["large", "small"]
+        );
+    }
+
+    #[test]
+    fn test_intersect() {
+        let a = TempDir::new("osync").expect("unable to create temp dir");
+        fs::write(a.path().join("same"), "hello").expect("unable to write test file");
+        fs::write(a.path().join("different"), "hello").expect("unable to write test file");
+        fs::write(a.path().join("only_a"), "hello").expect("unable to write test file");
+
+        let b = TempDir::new("osync").expect("unable to create temp dir");
+        fs::write(b.path().join("same"), "hello").expect("unable to write test file");
+        fs::write(b.path().join("different"), "world").expect("unable to write test file");
+        fs::write(b.path().join("only_b"), "hello").expect("unable to write test file");
+
+        let (a, _) = Index::compute(&a).expect("unable to compute index");
+        let (b, _) = Index::compute(&b).expect("unable to compute index");
+
+        assert_eq!(a.intersect(&b), ["different", "same"]);
+        assert_eq!(b.intersect(&a), ["different", "same"]);
+    }
+
+    #[test]
+    fn test_expect_exactly() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+        fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+        fs::write(dir.path().join("expected"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("sub/expected"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("extra"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let (missing, unexpected) = index.expect_exactly(&["expected", "sub/expected", "missing"]);
+        assert_eq!(missing, ["missing"]);
+        assert_eq!(unexpected, ["extra"]);
+
+        let (missing, unexpected) = index.expect_exactly(&["expected", "extra", "sub/expected"]);
+        assert!(missing.is_empty());
+        assert!(unexpected.is_empty());
+    }
+
+    #[test]
+    fn test_shard() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+        for i in 0..100 {
+            fs::write(dir.path().join(format!("{}", i)), format!("{}", i))
+                .expect("unable to write test file");
+        }
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        let shards = index.shard(4);
+        assert_eq!(shards.len(), 4);
+
+        let mut files = HashMap::new();
+        for shard in &shards {
+            assert!(!shard.is_empty());
+            assert_eq!(shard.metadata.len(), shard.len());
+            for (path, hash) in shard.files() {
+                assert_eq!(shard.metadata(path), index.metadata(path));
+                // the shards are disjoint
+                assert!(files.insert(path.to_string(), hash.to_string()).is_none());
+            }
+        }
+        assert_eq!(&files, index.files());
+    }
+
+    #[test]
+    fn test_shared_content() {
+        let a = TempDir::new("osync").expect("unable to create temp dir");
+        fs::write(a.path().join("hello"), "hello").expect("unable to write test file");
+        fs::write(a.path().join("hello2"), "hello").expect("unable to write test file");
+        fs::write(a.path().join("world"), "world").expect("unable to write test file");
+
+        let b = TempDir::new("osync").expect("unable to create temp dir");
+        fs::write(b.path().join("copy"), "hello").expect("unable to write test file");
+        fs::write(b.path().join("world"), "world").expect("unable to write test file");
+        fs::write(b.path().join("new"), "new").expect("unable to write test file");
+
+        let (a, _) = Index::compute(&a).expect("unable to compute index");
+        let (b, _) = Index::compute(&b).expect("unable to compute index");
+
+        let shared = a.shared_content(&b);
+        assert_eq!(shared.len(), 2);
+        assert_eq!(shared["copy"], ["hello", "hello2"]);
+        assert_eq!(shared["world"], ["world"]);
+        assert!(!shared.contains_key("new"));
+    }
+
+    #[test]
+    fn test_diff_different_roots() {
+        let a = TempDir::new("osync").expect("unable to create temp dir");
+        let b = TempDir::new("osync").expect("unable to create temp dir");
+        for dir in &[&a, &b] {
+            fs::create_dir(dir.path().join("sub")).expect("unable to create dir");
+            fs::write(dir.path().join("sub").join("test"), "hello")
+                .expect("unable to write test file");
+        }
+
+        let (a, _) = Index::compute(&a).expect("unable to compute index");
+        let (b, _) = Index::compute(&b).expect("unable to compute index");
+        assert_ne!(a.path(), b.path());
+
+        let (changed_files, deleted_files) = a.diff(&b);
+        assert!(changed_files.is_empty());
+        assert!(deleted_files.is_empty());
+        assert!(a.diff_result(&b).is_empty());
+    }
+
+    #[test]
+    fn test_checked_diff() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let (a, _) = Index::compute(&dir).expect("unable to compute index");
+        let sumfile = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  test\n";
+        let b = Index::import_sumfile(sumfile.as_bytes(), &dir).expect("unable to import sumfile");
+
+        let err = a.checked_diff(&b).expect_err("algorithms should mismatch");
+        assert!(err.is::<AlgorithmMismatch>());
+        assert_eq!(err.to_string(), "algorithm mismatch: sha1 != sha256");
+
+        let (changed_files, deleted_files) = a.checked_diff(&a).expect("unable to diff");
+        assert!(changed_files.is_empty());
+        assert!(deleted_files.is_empty());
+
+        // the salted checksums cannot be compared to the plain ones
+        let options = ComputeOptions::new().salt("secret");
+        let (salted, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+        let err = a.checked_diff(&salted).expect_err("salts should mismatch");
+        assert_eq!(err.to_string(), "algorithm mismatch: sha1 != sha1 (salted)");
+        assert!(a.shared_content(&salted).is_empty());
+        assert!(salted.checked_diff(&salted).is_ok());
+    }
+
+    #[test]
+    fn test_diff_directory() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("test"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+        index.save().expect("unable to save index");
+
+        // modify the file after the index has been saved
+        fs::write(dir.path().join("test"), "world").expect("unable to write test file");
+
+        let index = Index::load(&dir).expect("unable to load index");
+        let (changed_files, deleted_files) =
+            index.diff_directory().expect("unable to diff directory");
+        assert_eq!(changed_files, vec!["test"]);
+        assert!(deleted_files.is_empty());
+    }
+
+    #[test]
+    fn test_diff_directory_with_options() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "hello").expect("unable to write test file");
+
+        let options = ComputeOptions::new().path_in_digest(true).salt("secret");
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        fs::write(dir.path().join("a"), "world").expect("unable to write test file");
+
+        let (changed_files, deleted_files) = index
+            .diff_directory_with_options(&options)
+            .expect("unable to diff directory");
+        assert_eq!(changed_files, vec!["a"]);
+        assert!(deleted_files.is_empty());
+
+        // the salted checksums cannot be compared to the plain ones
+        assert!(index.diff_directory().is_err());
+    }
 }
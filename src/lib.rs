@@ -1,2 +1,7 @@
+pub mod backend;
+pub mod diff;
+pub mod ignore;
 pub mod index;
+pub mod lock;
 pub mod sync;
+pub mod verify;
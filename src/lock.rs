@@ -0,0 +1,74 @@
+use std::error::Error;
+use std::fs;
+use std::fs::OpenOptions;
+use std::io;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process;
+
+/// The name of the lock file.
+pub const LOCK_FILE: &str = ".osync.lock";
+
+/// An advisory lock on a directory, preventing many osync processes
+/// from computing or saving the index of the same directory concurrently.
+/// The lock is released when dropped.
+pub struct Lock {
+    path: PathBuf,
+}
+
+impl Lock {
+    /// Acquire the lock of given directory.
+    /// Fails immediately if the directory is already locked.
+    pub fn acquire<P: AsRef<Path>>(directory: P) -> Result<Lock, Box<dyn Error>> {
+        let path = directory.as_ref().join(LOCK_FILE);
+
+        let mut file = match OpenOptions::new().write(true).create_new(true).open(&path) {
+            Ok(file) => file,
+            Err(e) if e.kind() == io::ErrorKind::AlreadyExists => {
+                return Err(format!(
+                    "directory is locked by another process (remove {} if it is not)",
+                    path.display()
+                )
+                .into())
+            }
+            Err(e) => return Err(e.into()),
+        };
+
+        // record the owner of the lock to help troubleshooting stale locks
+        writeln!(file, "{}", process::id())?;
+
+        Ok(Lock { path })
+    }
+
+    /// Release the lock.
+    pub fn release(self) {}
+}
+
+impl Drop for Lock {
+    fn drop(&mut self) {
+        let _ = fs::remove_file(&self.path);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use tempdir::TempDir;
+
+    use crate::lock::{Lock, LOCK_FILE};
+
+    #[test]
+    fn test_lock() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        let lock = Lock::acquire(&dir).expect("unable to acquire lock");
+        assert!(dir.path().join(LOCK_FILE).exists());
+
+        // a second acquire fails fast
+        assert!(Lock::acquire(&dir).is_err());
+
+        lock.release();
+        assert!(!dir.path().join(LOCK_FILE).exists());
+
+        let _lock = Lock::acquire(&dir).expect("unable to acquire lock");
+    }
+}
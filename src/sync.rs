@@ -19,6 +19,8 @@ pub trait Sync {
     ) -> Result<bool, Box<dyn Error>>;
 }
 
+type ConfirmDeletion = Box<dyn Fn(&str) -> bool>;
+
 /// A synchronizer which save by FTP.
 pub struct FtpSync {
     // the FTP session
@@ -28,6 +30,8 @@ pub struct FtpSync {
     // create a local cache of existing directories
     // so that we won't waste time trying to create them again
     existing_directories: HashMap<String, bool>,
+    // approve each pending deletion, the denied ones are skipped
+    confirm_deletion: Option<ConfirmDeletion>,
 }
 
 impl Sync for FtpSync {
@@ -38,7 +42,7 @@ impl Sync for FtpSync {
         assume_directories: bool,
     ) -> Result<bool, Box<dyn Error>> {
         // compute diff
-        let (changed_files, deleted_files) = previous_index.diff(current_index);
+        let (changed_files, deleted_files) = previous_index.checked_diff(current_index)?;
         println!("-> {} files changed", changed_files.len());
         println!("-> {} files deleted", deleted_files.len());
 
@@ -63,6 +67,12 @@ impl Sync for FtpSync {
             }
         }
 
+        // the denied deletions are skipped
+        let (deleted_files, denied_files) = match self.ftp_session {
+            Some(_) => self.confirmed_deletions(&deleted_files),
+            None => (deleted_files, Vec::new()),
+        };
+
         if self.ftp_session.is_some() {
             // create progress bar
             let pb = ProgressBar::new((changed_files.len() + deleted_files.len()) as u64);
@@ -75,7 +85,7 @@ impl Sync for FtpSync {
         }
 
         // everything is fine, save index to file
-        current_index.save()?;
+        save_index(current_index, previous_index, &denied_files)?;
 
         Ok(self.ftp_session.is_none())
     }
@@ -115,9 +125,29 @@ impl FtpSync {
             ftp_session,
             remote_dir: remote_dir.to_string(),
             existing_directories: HashMap::new(),
+            confirm_deletion: None,
         })
     }
 
+    /// Route each pending deletion through given function before applying it,
+    /// so that f.e a UI can approve (`true`) or deny (`false`) it.
+    /// The denied deletions are skipped.
+    pub fn confirm_deletion<F>(mut self, confirm: F) -> FtpSync
+    where
+        F: Fn(&str) -> bool + 'static,
+    {
+        self.confirm_deletion = Some(Box::new(confirm));
+        self
+    }
+
+    /// Returns the files whose deletion has been approved, and the denied ones.
+    fn confirmed_deletions(&self, files: &[String]) -> (Vec<String>, Vec<String>) {
+        match &self.confirm_deletion {
+            Some(confirm) => files.iter().cloned().partition(|f| confirm(f)),
+            None => (files.to_vec(), Vec::new()),
+        }
+    }
+
     fn process_changed_files(
         &mut self,
         progress_bar: &ProgressBar,
@@ -133,7 +163,7 @@ impl FtpSync {
             self.make_directories(&format!("{}/{}", &self.remote_dir, parent))?;
 
             // store the file on the server
-            let mut content = File::open(previous_index.path().join(path))?;
+            let mut content = File::open(previous_index.abs_path(path))?;
             self.ftp_session
                 .as_mut()
                 .unwrap()
@@ -208,3 +238,75 @@ impl FtpSync {
         Ok(false)
     }
 }
+
+/// Save the current index, keeping the entries of the previous index whose deletion
+/// has been denied so that the deletion of the remote files is asked again next time.
+fn save_index(
+    current_index: &Index,
+    previous_index: &Index,
+    denied_files: &[String],
+) -> Result<(), Box<dyn Error>> {
+    if denied_files.is_empty() {
+        return current_index.save();
+    }
+
+    let mut index = current_index.clone();
+    for path in denied_files {
+        index.copy_entry(previous_index, path);
+    }
+    index.save()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+
+    use tempdir::TempDir;
+
+    use crate::index::Index;
+    use crate::sync::{save_index, FtpSync};
+
+    #[test]
+    fn test_confirm_deletion() {
+        let files = vec!["a".to_string(), "b".to_string()];
+
+        let synchronizer = FtpSync::new(&None).expect("unable to create synchronizer");
+        let (confirmed, denied) = synchronizer.confirmed_deletions(&files);
+        assert_eq!(confirmed, files);
+        assert!(denied.is_empty());
+
+        let synchronizer = synchronizer.confirm_deletion(|path| path != "b");
+        let (confirmed, denied) = synchronizer.confirmed_deletions(&files);
+        assert_eq!(confirmed, ["a"]);
+        assert_eq!(denied, ["b"]);
+    }
+
+    #[test]
+    fn test_save_index_denied_deletions() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("c"), "hello").expect("unable to write test file");
+
+        let (previous_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::remove_file(dir.path().join("a")).expect("unable to remove test file");
+        fs::remove_file(dir.path().join("b")).expect("unable to remove test file");
+        let (current_index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        // the denied deletion is kept in the saved index
+        save_index(&current_index, &previous_index, &["b".to_string()])
+            .expect("unable to save index");
+        let saved_index = Index::load(&dir).expect("unable to load index");
+        assert_eq!(saved_index.len(), 2);
+        assert_eq!(saved_index["b"], previous_index["b"]);
+        assert!(!saved_index.files().contains_key("a"));
+
+        // so that it is reported as deleted again on next run
+        let (_, deleted_files) = saved_index
+            .checked_diff(&current_index)
+            .expect("unable to diff indexes");
+        assert_eq!(deleted_files, ["b"]);
+    }
+}
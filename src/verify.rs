@@ -0,0 +1,481 @@
+use std::collections::HashMap;
+use std::error::Error;
+use std::fs;
+use std::io;
+use std::path::Path;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::thread;
+
+use crate::index::{hash_file, ComputeOptions, Index, EMPTY_CHECKSUM};
+
+/// The status of a file after having been checked against the index.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum VerifyStatus {
+    Ok,
+    Mismatched,
+    Missing,
+}
+
+/// The result of the verification of a directory against its index.
+#[derive(Default)]
+pub struct VerifyResult {
+    ok: Vec<String>,
+    mismatched: Vec<String>,
+    missing: Vec<String>,
+    errors: Vec<(String, io::Error)>,
+}
+
+impl VerifyResult {
+    /// Returns the files whose content matches the index.
+    pub fn ok(&self) -> &[String] {
+        &self.ok
+    }
+
+    /// Returns the files whose content differs from the index.
+    pub fn mismatched(&self) -> &[String] {
+        &self.mismatched
+    }
+
+    /// Returns the indexed files which no longer exist.
+    pub fn missing(&self) -> &[String] {
+        &self.missing
+    }
+
+    /// Returns the files which could not be verified, with the reason.
+    pub fn errors(&self) -> &[(String, io::Error)] {
+        &self.errors
+    }
+
+    /// Returns `true` if all the indexed files have been verified successfully.
+    pub fn is_ok(&self) -> bool {
+        self.mismatched.is_empty() && self.missing.is_empty() && self.errors.is_empty()
+    }
+
+    fn add(&mut self, path: &str, status: io::Result<VerifyStatus>) {
+        match status {
+            Ok(VerifyStatus::Ok) => self.ok.push(path.to_string()),
+            Ok(VerifyStatus::Mismatched) => self.mismatched.push(path.to_string()),
+            Ok(VerifyStatus::Missing) => self.missing.push(path.to_string()),
+            Err(e) => self.errors.push((path.to_string(), e)),
+        }
+    }
+}
+
+/// The result of the verification of a directory against a manifest.
+#[derive(Default)]
+pub struct ManifestResult {
+    mismatched: Vec<String>,
+    missing: Vec<String>,
+    extra: Vec<String>,
+}
+
+impl ManifestResult {
+    /// Returns the files whose content differs from the manifest.
+    pub fn mismatched(&self) -> &[String] {
+        &self.mismatched
+    }
+
+    /// Returns the files of the manifest missing from the directory.
+    pub fn missing(&self) -> &[String] {
+        &self.missing
+    }
+
+    /// Returns the files of the directory not in the manifest.
+    pub fn extra(&self) -> &[String] {
+        &self.extra
+    }
+
+    /// Returns `true` if the directory matches the manifest exactly.
+    pub fn is_ok(&self) -> bool {
+        self.mismatched.is_empty() && self.missing.is_empty() && self.extra.is_empty()
+    }
+}
+
+impl Index {
+    /// Hash again each indexed file and compare it against the index.
+    /// A file which cannot be read does not abort the verification,
+    /// the error is reported and the other files are still verified.
+    pub fn verify(&self) -> VerifyResult {
+        self.verify_with_options(&ComputeOptions::default())
+    }
+
+    /// Like `Index::verify`, hashing the files using given options, which should be
+    /// the ones the index has been computed with (f.e `ComputeOptions::path_in_digest`),
+    /// otherwise each file would be reported as mismatched.
+    /// The files cannot be verified (and are reported as errors) if the options
+    /// use another algorithm than the index, or are not salted like it.
+    pub fn verify_with_options(&self, options: &ComputeOptions) -> VerifyResult {
+        let mut result = VerifyResult::default();
+        self.verify_stream_with_options(options, |path, status| result.add(path, status));
+        result
+    }
+
+    /// Like `Index::verify`, for an index computed using given secret salt
+    /// (see `ComputeOptions::salt`), which is not recorded in the index.
+    pub fn verify_with_salt(&self, secret: &str) -> VerifyResult {
+        self.verify_with_options(&ComputeOptions::new().salt(secret))
+    }
+
+    /// Like `Index::verify`, but report the status of each file (in order)
+    /// to given function as soon as it has been checked, f.e to update a UI live.
+    pub fn verify_stream<F>(&self, on_result: F)
+    where
+        F: FnMut(&str, io::Result<VerifyStatus>),
+    {
+        self.verify_stream_with_options(&ComputeOptions::default(), on_result)
+    }
+
+    /// Like `Index::verify_stream`, hashing the files using given options
+    /// (see `Index::verify_with_options`).
+    pub fn verify_stream_with_options<F>(&self, options: &ComputeOptions, mut on_result: F)
+    where
+        F: FnMut(&str, io::Result<VerifyStatus>),
+    {
+        let mut paths: Vec<&String> = self.files().keys().collect();
+        paths.sort();
+
+        for path in paths {
+            on_result(path, self.verify_file(path, options));
+        }
+    }
+
+    /// Like `Index::verify`, but hash the files using given number of threads.
+    /// The result does not depend on the number of threads.
+    pub fn verify_parallel(&self, workers: usize) -> VerifyResult {
+        self.verify_parallel_with_options(workers, &ComputeOptions::default())
+    }
+
+    /// Like `Index::verify_parallel`, hashing the files using given options
+    /// (see `Index::verify_with_options`).
+    pub fn verify_parallel_with_options(
+        &self,
+        workers: usize,
+        options: &ComputeOptions,
+    ) -> VerifyResult {
+        let mut paths: Vec<&String> = self.files().keys().collect();
+        paths.sort();
+
+        // the index of the next file to verify
+        let next = AtomicUsize::new(0);
+        let mut statuses: Vec<Option<io::Result<VerifyStatus>>> =
+            paths.iter().map(|_| None).collect();
+
+        thread::scope(|s| {
+            let handles: Vec<_> = (0..workers.max(1))
+                .map(|_| {
+                    s.spawn(|| {
+                        let mut statuses = Vec::new();
+                        loop {
+                            let i = next.fetch_add(1, Ordering::SeqCst);
+                            if i >= paths.len() {
+                                break;
+                            }
+                            statuses.push((i, self.verify_file(paths[i], options)));
+                        }
+                        statuses
+                    })
+                })
+                .collect();
+
+            for handle in handles {
+                for (i, status) in handle.join().unwrap() {
+                    statuses[i] = Some(status);
+                }
+            }
+        });
+
+        // classify the files in order so that the result is deterministic
+        let mut result = VerifyResult::default();
+        for (path, status) in paths.into_iter().zip(statuses) {
+            result.add(path, status.unwrap());
+        }
+
+        result
+    }
+
+    fn verify_file(&self, path: &str, options: &ComputeOptions) -> io::Result<VerifyStatus> {
+        // the checksums computed using another algorithm (or salt) cannot be compared
+        if let Err(e) = self.check_options(options) {
+            return Err(io::Error::new(io::ErrorKind::InvalidInput, e));
+        }
+
+        let file_path = self.abs_path(path);
+        let metadata = match fs::metadata(&file_path) {
+            Ok(metadata) => metadata,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(VerifyStatus::Missing),
+            Err(e) => return Err(e),
+        };
+
+        // the empty files may have been indexed without being hashed
+        if self[path] == EMPTY_CHECKSUM {
+            return if metadata.len() == 0 {
+                Ok(VerifyStatus::Ok)
+            } else {
+                Ok(VerifyStatus::Mismatched)
+            };
+        }
+
+        if hash_file(options, &file_path, path)? == self[path] {
+            Ok(VerifyStatus::Ok)
+        } else {
+            Ok(VerifyStatus::Mismatched)
+        }
+    }
+}
+
+/// Compare the files of given directory against a manifest (path -> checksum)
+/// of their expected content. This is like a diff where one side is supplied directly.
+pub fn verify_manifest<P: AsRef<Path>>(
+    directory: P,
+    manifest: &HashMap<String, String>,
+) -> Result<ManifestResult, Box<dyn Error>> {
+    let (index, _) = Index::compute(directory)?;
+
+    let mut result = ManifestResult::default();
+    for (path, hash) in manifest {
+        match index.files().get(path) {
+            None => result.missing.push(path.to_string()),
+            Some(current_hash) if current_hash != hash => result.mismatched.push(path.to_string()),
+            _ => {}
+        }
+    }
+
+    for path in index.files().keys() {
+        if !manifest.contains_key(path) {
+            result.extra.push(path.to_string());
+        }
+    }
+
+    result.mismatched.sort();
+    result.missing.sort();
+    result.extra.sort();
+
+    Ok(result)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+    use std::fs;
+
+    use tempdir::TempDir;
+
+    use crate::index::{ComputeOptions, Index};
+    use crate::verify::{verify_manifest, VerifyStatus};
+
+    #[test]
+    fn test_verify() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("ok"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("mismatched"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("missing"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("unreadable"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("mismatched"), "world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("missing")).expect("unable to remove test file");
+
+        // replace the file by a directory so that it cannot be read
+        fs::remove_file(dir.path().join("unreadable")).expect("unable to remove test file");
+        fs::create_dir(dir.path().join("unreadable")).expect("unable to create dir");
+
+        let result = index.verify();
+        assert_eq!(result.ok(), ["ok"]);
+        assert_eq!(result.mismatched(), ["mismatched"]);
+        assert_eq!(result.missing(), ["missing"]);
+        assert_eq!(result.errors().len(), 1);
+        assert_eq!(result.errors()[0].0, "unreadable");
+        assert!(!result.is_ok());
+    }
+
+    #[test]
+    fn test_verify_stream() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("ok"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("mismatched"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("missing"), "hello").expect("unable to write test file");
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        fs::write(dir.path().join("mismatched"), "world").expect("unable to write test file");
+        fs::remove_file(dir.path().join("missing")).expect("unable to remove test file");
+
+        let mut statuses = Vec::new();
+        index.verify_stream(|path, status| {
+            statuses.push((path.to_string(), status.expect("unable to verify file")))
+        });
+
+        let result = index.verify();
+        let mut expected = Vec::new();
+        for path in result.mismatched() {
+            expected.push((path.to_string(), VerifyStatus::Mismatched));
+        }
+        for path in result.missing() {
+            expected.push((path.to_string(), VerifyStatus::Missing));
+        }
+        for path in result.ok() {
+            expected.push((path.to_string(), VerifyStatus::Ok));
+        }
+        expected.sort_by(|a, b| a.0.cmp(&b.0));
+        assert_eq!(statuses, expected);
+    }
+
+    #[test]
+    fn test_verify_stream_with_options() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("a"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("b"), "world").expect("unable to write test file");
+
+        let options = ComputeOptions::new().path_in_digest(true);
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        // the untouched files are verified using the same digest
+        let mut statuses = Vec::new();
+        index.verify_stream_with_options(&options, |path, status| {
+            statuses.push((path.to_string(), status.expect("unable to verify file")))
+        });
+        assert_eq!(
+            statuses,
+            [
+                ("a".to_string(), VerifyStatus::Ok),
+                ("b".to_string(), VerifyStatus::Ok)
+            ]
+        );
+    }
+
+    #[test]
+    fn test_verify_with_salt() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("ok"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("mismatched"), "hello").expect("unable to write test file");
+
+        let options = ComputeOptions::new().salt("secret");
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        fs::write(dir.path().join("mismatched"), "world").expect("unable to write test file");
+
+        let result = index.verify_with_salt("secret");
+        assert_eq!(result.ok(), ["ok"]);
+        assert_eq!(result.mismatched(), ["mismatched"]);
+        assert!(result.errors().is_empty());
+
+        // the content does not match using another secret
+        let result = index.verify_with_salt("other secret");
+        assert_eq!(result.mismatched().len(), 2);
+
+        // the salt is required
+        assert_eq!(index.verify().errors().len(), 2);
+    }
+
+    #[test]
+    fn test_verify_with_options() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("ok"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("mismatched"), "hello").expect("unable to write test file");
+
+        let options = ComputeOptions::new().path_in_digest(true);
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        fs::write(dir.path().join("mismatched"), "world").expect("unable to write test file");
+
+        let result = index.verify_with_options(&options);
+        assert_eq!(result.ok(), ["ok"]);
+        assert_eq!(result.mismatched(), ["mismatched"]);
+        assert!(result.errors().is_empty());
+
+        // the default options do not digest the paths
+        assert_eq!(index.verify().mismatched().len(), 2);
+
+        // the salted checksums cannot be compared against the index
+        let options = ComputeOptions::new().path_in_digest(true).salt("secret");
+        assert_eq!(index.verify_with_options(&options).errors().len(), 2);
+    }
+
+    #[test]
+    fn test_verify_parallel() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        for i in 0..200 {
+            fs::write(dir.path().join(format!("{}", i)), format!("{}", i))
+                .expect("unable to write test file");
+        }
+
+        let (index, _) = Index::compute(&dir).expect("unable to compute index");
+
+        for i in (0..200).step_by(7) {
+            fs::write(dir.path().join(format!("{}", i)), "modified")
+                .expect("unable to write test file");
+        }
+        for i in (3..200).step_by(11) {
+            fs::remove_file(dir.path().join(format!("{}", i))).expect("unable to remove test file");
+        }
+
+        let expected = index.verify();
+        assert!(!expected.mismatched().is_empty());
+        assert!(!expected.missing().is_empty());
+
+        for workers in &[1, 4, 16] {
+            let result = index.verify_parallel(*workers);
+            assert_eq!(result.ok(), expected.ok());
+            assert_eq!(result.mismatched(), expected.mismatched());
+            assert_eq!(result.missing(), expected.missing());
+            assert!(result.errors().is_empty());
+        }
+    }
+
+    #[test]
+    fn test_verify_parallel_with_salt() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        for i in 0..20 {
+            fs::write(dir.path().join(format!("{}", i)), format!("{}", i))
+                .expect("unable to write test file");
+        }
+
+        let options = ComputeOptions::new().salt("secret");
+        let (index, _) =
+            Index::compute_with_options(&dir, &options).expect("unable to compute index");
+
+        fs::write(dir.path().join("7"), "modified").expect("unable to write test file");
+
+        let expected = index.verify_with_salt("secret");
+        assert_eq!(expected.mismatched(), ["7"]);
+
+        let result = index.verify_parallel_with_options(4, &options);
+        assert_eq!(result.ok(), expected.ok());
+        assert_eq!(result.mismatched(), expected.mismatched());
+        assert!(result.errors().is_empty());
+    }
+
+    #[test]
+    fn test_verify_manifest() {
+        let dir = TempDir::new("osync").expect("unable to create temp dir");
+
+        fs::write(dir.path().join("ok"), "hello").expect("unable to write test file");
+        fs::write(dir.path().join("mismatched"), "world").expect("unable to write test file");
+        fs::write(dir.path().join("extra"), "hello").expect("unable to write test file");
+
+        let mut manifest = HashMap::new();
+        for path in &["ok", "mismatched", "missing"] {
+            manifest.insert(
+                path.to_string(),
+                "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d".to_string(),
+            );
+        }
+
+        let result = verify_manifest(&dir, &manifest).expect("unable to verify manifest");
+        assert_eq!(result.mismatched(), ["mismatched"]);
+        assert_eq!(result.missing(), ["missing"]);
+        assert_eq!(result.extra(), ["extra"]);
+        assert!(!result.is_ok());
+    }
+}